@@ -1,20 +1,113 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	GatewayURL          string `toml:"gateway_url"`
+	GatewayURL string `toml:"gateway_url"`
+	// AgentID identifies this host to the gateway; when empty a generated ID is
+	// persisted in agent_id next to the config file.
+	AgentID             string `toml:"agent_id"`
 	PollIntervalSeconds int    `toml:"poll_interval_seconds"`
 	LogLevel            string `toml:"log_level"`
 	DBPath              string `toml:"db_path"`
 	PolicyURL           string `toml:"policy_url"`
 	PolicyPollSeconds   int    `toml:"policy_poll_seconds"`
+	// long-poll endpoint that answers when a new policy version is published;
+	// while it is reachable the policy_url poll is skipped
+	PolicyPushURL string `toml:"policy_push_url"`
+	// when policy_keys are listed, a fetched policy is only stored if the
+	// detached Ed25519 signature at policy_signature_url (default policy_url
+	// + ".sig") was made by one of them
+	PolicySignatureURL string      `toml:"policy_signature_url"`
+	PolicyKeys         []PolicyKey `toml:"policy_keys"`
+	// lifecycle state new policy revisions start in unless the policy sets
+	// one (staged, dry_run or active); staged revisions are promoted to active
+	// after policy_staging_grace_seconds, or only by an operator when 0
+	PolicyDefaultState        string `toml:"policy_default_state"`
+	PolicyStagingGraceSeconds int    `toml:"policy_staging_grace_seconds"`
+	// transport authentication, applied to gateway uploads and policy fetches.
+	// Secret files (token, client key) must be mode 0600.
+	GatewayTokenFile string   `toml:"gateway_token_file"`
+	TLSClientCert    string   `toml:"tls_client_cert"`
+	TLSClientKey     string   `toml:"tls_client_key"`
+	TLSCAFile        string   `toml:"tls_ca_file"`
+	TLSPinnedSHA256  []string `toml:"tls_pinned_sha256"`
+	// outbound network settings shared by all HTTP traffic. Without proxy_url
+	// the HTTP(S)_PROXY environment variables apply; no_proxy lists hosts,
+	// domains or CIDRs reached directly. bind_interface picks the interface's
+	// first IPv4 (else IPv6) address as source; bind_address sets it directly.
+	ProxyURL                   string   `toml:"proxy_url"`
+	ProxyUsername              string   `toml:"proxy_username"`
+	ProxyPasswordFile          string   `toml:"proxy_password_file"`
+	NoProxy                    []string `toml:"no_proxy"`
+	HTTPTimeoutSeconds         int      `toml:"http_timeout_seconds"`
+	DialTimeoutSeconds         int      `toml:"dial_timeout_seconds"`
+	TLSHandshakeTimeoutSeconds int      `toml:"tls_handshake_timeout_seconds"`
+	BindAddress                string   `toml:"bind_address"`
+	BindInterface              string   `toml:"bind_interface"`
+	// shared key (0600 file) for HMAC signing of event uploads; signed
+	// responses are verified, and unsigned ones rejected only when required
+	GatewayHMACKeyFile            string `toml:"gateway_hmac_key_file"`
+	GatewayRequireSignedResponses bool   `toml:"gateway_require_signed_responses"`
+	// gateway upload batching; batches are bounded before gzip compression
+	GatewayMaxBatchEvents     int  `toml:"gateway_max_batch_events"`
+	GatewayMaxBatchKB         int  `toml:"gateway_max_batch_kb"`
+	GatewayDisableCompression bool `toml:"gateway_disable_compression"`
+	// accept a whole batch on any 2xx response, for gateways that do not
+	// answer with per-event acknowledgements
+	GatewayLegacyAcks bool `toml:"gateway_legacy_acks"`
+	// circuit breaker: stop sending after this many consecutive failures (negative
+	// disables) for a cooldown that doubles while the gateway stays down
+	GatewayBreakerThreshold          int `toml:"gateway_breaker_threshold"`
+	GatewayBreakerCooldownSeconds    int `toml:"gateway_breaker_cooldown_seconds"`
+	GatewayBreakerMaxCooldownSeconds int `toml:"gateway_breaker_max_cooldown_seconds"`
+	// outbox delivery settings; DeliveryMaxAttempts of 0 retries forever
+	DeliveryBatchSize         int `toml:"delivery_batch_size"`
+	DeliveryMaxBackoffSeconds int `toml:"delivery_max_backoff_seconds"`
+	DeliveryMaxAttempts       int `toml:"delivery_max_attempts"`
+	// event retention; a negative limit disables it
+	RetentionIntervalSeconds int            `toml:"retention_interval_seconds"`
+	RetentionMaxAgeDays      int            `toml:"retention_max_age_days"`
+	RetentionMaxRows         int64          `toml:"retention_max_rows"`
+	RetentionMaxDBMB         int64          `toml:"retention_max_db_mb"`
+	RetentionTypeTTLHours    map[string]int `toml:"retention_type_ttl_hours"`
+	// how often an ongoing policy violation is re-reported; negative never re-alerts
+	ViolationRealertSeconds int `toml:"violation_realert_seconds"`
+	// output sinks events are fanned out to; when none are configured events
+	// go to gateway_url only
+	Sinks []SinkConfig `toml:"sinks"`
+}
+
+// SinkConfig describes one [[sinks]] entry. Type is http, file or syslog;
+// Types and MinSeverity filter which events the sink receives.
+type SinkConfig struct {
+	Name        string   `toml:"name"`
+	Type        string   `toml:"type"`
+	Types       []string `toml:"types"`
+	MinSeverity string   `toml:"min_severity"`
+	// http: upload URL, defaults to gateway_url
+	URL string `toml:"url"`
+	// file: NDJSON file events are appended to
+	Path string `toml:"path"`
+	// syslog: RFC 5424 over udp or tcp; facility 0 means local0
+	Network  string `toml:"network"`
+	Address  string `toml:"address"`
+	Facility int    `toml:"facility"`
+}
+
+// PolicyKey is a trusted policy signing key: an ID and a base64 Ed25519 public key.
+type PolicyKey struct {
+	ID        string `toml:"id"`
+	PublicKey string `toml:"public_key"`
 }
 
 func defaultConfig() *Config {
@@ -24,12 +117,29 @@ func defaultConfig() *Config {
 	}
 	dbPath := filepath.Join(progData, "SentinelAgent", "events.db")
 	return &Config{
-		GatewayURL:          "https://example.com/api",
-		PollIntervalSeconds: 60,
-		LogLevel:            "info",
-		DBPath:              dbPath,
-		PolicyURL:           "",
-		PolicyPollSeconds:   300,
+		GatewayURL:                       "https://example.com/api",
+		PollIntervalSeconds:              60,
+		LogLevel:                         "info",
+		DBPath:                           dbPath,
+		PolicyURL:                        "",
+		PolicyPollSeconds:                300,
+		PolicyDefaultState:               "active",
+		HTTPTimeoutSeconds:               15,
+		DialTimeoutSeconds:               10,
+		TLSHandshakeTimeoutSeconds:       10,
+		GatewayMaxBatchEvents:            500,
+		GatewayMaxBatchKB:                1024,
+		GatewayBreakerThreshold:          3,
+		GatewayBreakerCooldownSeconds:    30,
+		GatewayBreakerMaxCooldownSeconds: 600,
+		DeliveryBatchSize:                100,
+		DeliveryMaxBackoffSeconds:        600,
+		RetentionIntervalSeconds:         3600,
+		RetentionMaxAgeDays:              30,
+		RetentionMaxRows:                 500000,
+		RetentionMaxDBMB:                 1024,
+		RetentionTypeTTLHours:            map[string]int{"process_list": 168},
+		ViolationRealertSeconds:          3600,
 	}
 }
 
@@ -61,6 +171,9 @@ func Load() (*Config, error) {
 		if err := enc.Encode(cfg); err != nil {
 			return nil, err
 		}
+		if err := ensureAgentID(cfg, filepath.Dir(path)); err != nil {
+			return nil, err
+		}
 		return cfg, nil
 	}
 	var cfg Config
@@ -75,11 +188,94 @@ func Load() (*Config, error) {
 	if cfg.PollIntervalSeconds == 0 {
 		cfg.PollIntervalSeconds = def.PollIntervalSeconds
 	}
+	if cfg.PolicyPollSeconds == 0 {
+		cfg.PolicyPollSeconds = def.PolicyPollSeconds
+	}
+	if cfg.PolicyDefaultState == "" {
+		cfg.PolicyDefaultState = def.PolicyDefaultState
+	}
+	if cfg.PolicySignatureURL == "" && cfg.PolicyURL != "" {
+		cfg.PolicySignatureURL = cfg.PolicyURL + ".sig"
+	}
 	if cfg.DBPath == "" {
 		cfg.DBPath = def.DBPath
 	}
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = def.LogLevel
 	}
+	if cfg.HTTPTimeoutSeconds == 0 {
+		cfg.HTTPTimeoutSeconds = def.HTTPTimeoutSeconds
+	}
+	if cfg.DialTimeoutSeconds == 0 {
+		cfg.DialTimeoutSeconds = def.DialTimeoutSeconds
+	}
+	if cfg.TLSHandshakeTimeoutSeconds == 0 {
+		cfg.TLSHandshakeTimeoutSeconds = def.TLSHandshakeTimeoutSeconds
+	}
+	if cfg.GatewayMaxBatchEvents == 0 {
+		cfg.GatewayMaxBatchEvents = def.GatewayMaxBatchEvents
+	}
+	if cfg.GatewayMaxBatchKB == 0 {
+		cfg.GatewayMaxBatchKB = def.GatewayMaxBatchKB
+	}
+	if cfg.GatewayBreakerThreshold == 0 {
+		cfg.GatewayBreakerThreshold = def.GatewayBreakerThreshold
+	}
+	if cfg.GatewayBreakerCooldownSeconds == 0 {
+		cfg.GatewayBreakerCooldownSeconds = def.GatewayBreakerCooldownSeconds
+	}
+	if cfg.GatewayBreakerMaxCooldownSeconds == 0 {
+		cfg.GatewayBreakerMaxCooldownSeconds = def.GatewayBreakerMaxCooldownSeconds
+	}
+	if cfg.DeliveryBatchSize == 0 {
+		cfg.DeliveryBatchSize = def.DeliveryBatchSize
+	}
+	if cfg.DeliveryMaxBackoffSeconds == 0 {
+		cfg.DeliveryMaxBackoffSeconds = def.DeliveryMaxBackoffSeconds
+	}
+	if cfg.RetentionIntervalSeconds == 0 {
+		cfg.RetentionIntervalSeconds = def.RetentionIntervalSeconds
+	}
+	if cfg.RetentionMaxAgeDays == 0 {
+		cfg.RetentionMaxAgeDays = def.RetentionMaxAgeDays
+	}
+	if cfg.RetentionMaxRows == 0 {
+		cfg.RetentionMaxRows = def.RetentionMaxRows
+	}
+	if cfg.RetentionMaxDBMB == 0 {
+		cfg.RetentionMaxDBMB = def.RetentionMaxDBMB
+	}
+	if cfg.ViolationRealertSeconds == 0 {
+		cfg.ViolationRealertSeconds = def.ViolationRealertSeconds
+	}
+	if cfg.RetentionTypeTTLHours == nil {
+		cfg.RetentionTypeTTLHours = def.RetentionTypeTTLHours
+	}
+	if err := ensureAgentID(&cfg, filepath.Dir(path)); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+// ensureAgentID fills cfg.AgentID from the agent_id file in dir, generating and
+// persisting a random ID the first time.
+func ensureAgentID(cfg *Config, dir string) error {
+	if cfg.AgentID != "" {
+		return nil
+	}
+	path := filepath.Join(dir, "agent_id")
+	if b, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(b)) != "" {
+		cfg.AgentID = strings.TrimSpace(string(b))
+		return nil
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o644); err != nil {
+		return err
+	}
+	cfg.AgentID = id
+	return nil
+}
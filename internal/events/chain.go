@@ -0,0 +1,223 @@
+package events
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ChainReport is the outcome of walking the event hash chain.
+type ChainReport struct {
+	Checked  int64  `json:"checked"`
+	Anchors  int64  `json:"anchors"`
+	OK       bool   `json:"ok"`
+	BrokenAt int64  `json:"broken_at,omitempty"` // id of the first event that fails verification
+	Reason   string `json:"reason,omitempty"`
+	Head     string `json:"head"`
+}
+
+// Anchor stands in for the events deleted before EventID: it holds the
+// prev_hash that event links to.
+type Anchor struct {
+	EventID  int64  `json:"event_id"`
+	PrevHash string `json:"prev_hash"`
+}
+
+// chainHash links an event to its predecessor. Fields are length-prefixed so
+// no two different events can produce the same input.
+func chainHash(prev, timestamp, typ, payload string) string {
+	h := sha256.New()
+	for _, f := range []string{prev, timestamp, typ, payload} {
+		h.Write([]byte(strconv.Itoa(len(f))))
+		h.Write([]byte{':'})
+		h.Write([]byte(f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func chainHead(q interface {
+	QueryRow(string, ...any) *sql.Row
+}) (string, error) {
+	var head string
+	err := q.QueryRow(`SELECT head FROM chain_state WHERE id = 1`).Scan(&head)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return head, err
+}
+
+func setChainHead(tx *sql.Tx, head string) error {
+	_, err := tx.Exec(`INSERT INTO chain_state(id, head) VALUES (1, ?) ON CONFLICT(id) DO UPDATE SET head = excluded.head`, head)
+	return err
+}
+
+func chainAnchors(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}) ([]Anchor, error) {
+	rows, err := q.Query(`SELECT event_id, prev_hash FROM chain_anchors ORDER BY event_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Anchor{}
+	for rows.Next() {
+		var a Anchor
+		if err := rows.Scan(&a.EventID, &a.PrevHash); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// announcedAnchors collects the anchors listed by events_pruned events. Those
+// events are part of the chain, so an anchor row added behind the agent's
+// back is not among them.
+func announcedAnchors(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}) (map[int64]string, error) {
+	rows, err := q.Query(`SELECT payload FROM events WHERE type = 'events_pruned'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int64]string{}
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var res PruneResult
+		if json.Unmarshal([]byte(payload), &res) != nil {
+			continue
+		}
+		for _, a := range res.Anchored {
+			out[a.EventID] = a.PrevHash
+		}
+	}
+	return out, rows.Err()
+}
+
+// anchorGaps records, for every run of deleted ids, the prev_hash of the event
+// that now follows the gap, so verification can tell pruning from tampering.
+// When the newest events were deleted the anchor is placed on the next id the
+// table will assign. ids must be sorted ascending.
+func anchorGaps(tx *sql.Tx, ids []int64, now time.Time) (int64, error) {
+	var anchors int64
+	var covered int64
+	for _, d := range ids {
+		if d < covered {
+			continue
+		}
+		var next int64
+		var prev string
+		err := tx.QueryRow(`SELECT id, prev_hash FROM events WHERE id > ? ORDER BY id LIMIT 1`, d).Scan(&next, &prev)
+		if errors.Is(err, sql.ErrNoRows) {
+			var seq int64
+			if err := tx.QueryRow(`SELECT seq FROM sqlite_sequence WHERE name = 'events'`).Scan(&seq); err != nil {
+				return anchors, err
+			}
+			if prev, err = chainHead(tx); err != nil {
+				return anchors, err
+			}
+			next = seq + 1
+			covered = math.MaxInt64
+		} else if err != nil {
+			return anchors, err
+		} else {
+			covered = next
+		}
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO chain_anchors(event_id, prev_hash, created) VALUES (?, ?, ?)`,
+			next, prev, now.UTC().Format(time.RFC3339)); err != nil {
+			return anchors, err
+		}
+		anchors++
+	}
+	// anchors on events that have since been pruned themselves are superseded
+	_, err := tx.Exec(`DELETE FROM chain_anchors WHERE event_id NOT IN (SELECT id FROM events)
+        AND event_id <= (SELECT seq FROM sqlite_sequence WHERE name = 'events')`)
+	return anchors, err
+}
+
+// VerifyChain walks every stored event in id order and checks that each row's
+// hash matches its contents and links to the previous row, or to a pruning
+// anchor where earlier rows were deleted by retention. An anchor only counts
+// when an events_pruned event in the chain recorded it.
+func (s *sqliteStore) VerifyChain() (ChainReport, error) {
+	var rep ChainReport
+	list, err := chainAnchors(s.db)
+	if err != nil {
+		return rep, err
+	}
+	rep.Anchors = int64(len(list))
+	anchors := map[int64]string{}
+	for _, a := range list {
+		anchors[a.EventID] = a.PrevHash
+	}
+	announced, err := announcedAnchors(s.db)
+	if err != nil {
+		return rep, err
+	}
+	// the walk below checks the events that announced them
+	covers := func(id int64, prev string) string {
+		a, ok := anchors[id]
+		switch {
+		case !ok || a != prev:
+			return "no pruning anchor covers the gap"
+		case announced[id] != prev:
+			return "the pruning anchor over the gap is not recorded in any events_pruned event"
+		}
+		return ""
+	}
+	if rep.Head, err = chainHead(s.db); err != nil {
+		return rep, err
+	}
+
+	rows, err := s.db.Query(`SELECT id, timestamp, type, payload, prev_hash, hash FROM events ORDER BY id`)
+	if err != nil {
+		return rep, err
+	}
+	defer rows.Close()
+	expected := ""
+	for rows.Next() {
+		var id int64
+		var ts, typ, payload, prev, hash string
+		if err := rows.Scan(&id, &ts, &typ, &payload, &prev, &hash); err != nil {
+			return rep, err
+		}
+		rep.Checked++
+		if chainHash(prev, ts, typ, payload) != hash {
+			rep.BrokenAt, rep.Reason = id, "event contents do not match its hash"
+			return rep, nil
+		}
+		if prev != expected {
+			if why := covers(id, prev); why != "" {
+				rep.BrokenAt, rep.Reason = id, "prev_hash does not link to the previous event and "+why
+				return rep, nil
+			}
+		}
+		expected = hash
+	}
+	if err := rows.Err(); err != nil {
+		return rep, err
+	}
+	if expected != rep.Head {
+		// the newest events may have been pruned, in which case the next id to
+		// be assigned carries an anchor to the head
+		var seq int64
+		if err := s.db.QueryRow(`SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'events'), 0)`).Scan(&seq); err != nil {
+			return rep, err
+		}
+		if why := covers(seq+1, rep.Head); why != "" {
+			rep.Reason = "newest event does not match the recorded chain head and " + why
+			return rep, nil
+		}
+	}
+	rep.OK = true
+	return rep, nil
+}
@@ -0,0 +1,229 @@
+package events
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// dispatchMark names the counter holding the highest event id already routed to sinks.
+const dispatchMark = "dispatch_mark"
+
+// Dispatch routes up to limit stored events that have not been routed yet,
+// creating a pending delivery for each sink route names. Events no sink wants
+// are marked sent straight away. It returns how many events were routed.
+func (s *sqliteStore) Dispatch(route func(Event) []string, limit int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var mark int64
+	if err := tx.QueryRow(`SELECT value FROM counters WHERE name = ?`, dispatchMark).Scan(&mark); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	rows, err := tx.Query(`SELECT `+eventColumns+` FROM events
+        WHERE id > ? AND delivery_state = ? ORDER BY id LIMIT ?`, mark, DeliveryPending, limit)
+	if err != nil {
+		return 0, err
+	}
+	evts, err := scanEvents(rows)
+	rows.Close()
+	if err != nil || len(evts) == 0 {
+		return 0, err
+	}
+	ins, err := tx.Prepare(`INSERT OR IGNORE INTO deliveries(sink, event_id) VALUES (?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer ins.Close()
+	var unrouted []int64
+	for _, e := range evts {
+		sinks := route(e)
+		if len(sinks) == 0 {
+			unrouted = append(unrouted, e.ID)
+		}
+		for _, sink := range sinks {
+			if _, err := ins.Exec(sink, e.ID); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(unrouted) > 0 {
+		ph, args := inArgs(unrouted)
+		args = append([]any{DeliverySent}, args...)
+		if _, err := tx.Exec(`UPDATE events SET delivery_state = ? WHERE id IN (`+ph+`)`, args...); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO counters(name, value) VALUES (?, ?)
+        ON CONFLICT(name) DO UPDATE SET value = excluded.value`, dispatchMark, evts[len(evts)-1].ID); err != nil {
+		return 0, err
+	}
+	return len(evts), tx.Commit()
+}
+
+// Pending returns events awaiting delivery to sink that are due at now, oldest
+// first, with the upload sequence they were last sent under.
+func (s *sqliteStore) Pending(sink string, limit int, now time.Time) ([]Event, error) {
+	rows, err := s.db.Query(`SELECT `+qualify("events")+`, deliveries.sequence FROM deliveries
+        JOIN events ON events.id = deliveries.event_id
+        WHERE deliveries.sink = ? AND deliveries.state = ?
+            AND (deliveries.next_attempt IS NULL OR deliveries.next_attempt <= ?)
+        ORDER BY deliveries.event_id ASC LIMIT ?`, sink, DeliveryPending, now.UTC().Format(time.RFC3339), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Event{}
+	for rows.Next() {
+		var e Event
+		if err := scanEvent(rows, &e, &e.UploadSequence); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// AssignSequence increments counter and records its value as the upload
+// sequence of sink's deliveries of ids, in one transaction.
+func (s *sqliteStore) AssignSequence(sink, counter string, ids []int64) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var seq int64
+	if err := tx.QueryRow(`INSERT INTO counters(name, value) VALUES (?, 1)
+        ON CONFLICT(name) DO UPDATE SET value = value + 1 RETURNING value`, counter).Scan(&seq); err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		ph, args := inArgs(ids)
+		if _, err := tx.Exec(`UPDATE deliveries SET sequence = ? WHERE sink = ? AND event_id IN (`+ph+`)`,
+			append([]any{seq, sink}, args...)...); err != nil {
+			return 0, err
+		}
+	}
+	return seq, tx.Commit()
+}
+
+func (s *sqliteStore) ReleaseSequence(sink string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ph, args := inArgs(ids)
+	_, err := s.db.Exec(`UPDATE deliveries SET sequence = 0 WHERE sink = ? AND event_id IN (`+ph+`)`, append([]any{sink}, args...)...)
+	return err
+}
+
+func (s *sqliteStore) MarkSent(sink string, ids []int64) error {
+	return s.markDeliveries(sink, ids, `state = ?, next_attempt = NULL`, DeliverySent)
+}
+
+func (s *sqliteStore) MarkRetry(sink string, ids []int64, next time.Time, maxAttempts int) error {
+	return s.markDeliveries(sink, ids, `attempts = attempts + 1, next_attempt = ?,
+        state = CASE WHEN ? > 0 AND attempts + 1 >= ? THEN ? ELSE ? END`,
+		next.UTC().Format(time.RFC3339), maxAttempts, maxAttempts, DeliveryFailed, DeliveryPending)
+}
+
+func (s *sqliteStore) MarkFailed(sink string, ids []int64) error {
+	return s.markDeliveries(sink, ids, `state = ?, next_attempt = NULL`, DeliveryFailed)
+}
+
+// markDeliveries applies set to sink's deliveries of ids and settles the
+// aggregate delivery state of those events.
+func (s *sqliteStore) markDeliveries(sink string, ids []int64, set string, setArgs ...any) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ph, args := inArgs(ids)
+	if _, err := tx.Exec(`UPDATE deliveries SET `+set+` WHERE sink = ? AND event_id IN (`+ph+`)`,
+		append(append(setArgs, sink), args...)...); err != nil {
+		return err
+	}
+	if err := settle(tx, `id IN (`+ph+`)`, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AbandonSinks fails the pending deliveries to sinks not listed in keep, e.g.
+// after a sink was removed from the configuration, so their events can settle.
+func (s *sqliteStore) AbandonSinks(keep []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	where := `state = ?`
+	args := []any{DeliveryPending}
+	if len(keep) > 0 {
+		where += ` AND sink NOT IN (` + strings.TrimSuffix(strings.Repeat("?,", len(keep)), ",") + `)`
+		for _, k := range keep {
+			args = append(args, k)
+		}
+	}
+	res, err := tx.Exec(`UPDATE deliveries SET state = ?, next_attempt = NULL WHERE `+where, append([]any{DeliveryFailed}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	var mark int64
+	if err := tx.QueryRow(`SELECT value FROM counters WHERE name = ?`, dispatchMark).Scan(&mark); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err := settle(tx, `id <= ?`, mark); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// Redeliver queues every already-routed event stored at or after since for
+// delivery to sink again, whatever its earlier outcome, and returns how many were queued.
+func (s *sqliteStore) Redeliver(sink string, since time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var mark int64
+	if err := tx.QueryRow(`SELECT value FROM counters WHERE name = ?`, dispatchMark).Scan(&mark); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	ts := since.UTC().Format(time.RFC3339)
+	res, err := tx.Exec(`INSERT INTO deliveries(sink, event_id) SELECT ?, id FROM events WHERE timestamp >= ? AND id <= ?
+        ON CONFLICT(sink, event_id) DO UPDATE SET state = excluded.state, attempts = 0, next_attempt = NULL, sequence = 0`, sink, ts, mark)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE events SET delivery_state = ? WHERE timestamp >= ? AND id <= ?`, DeliveryPending, ts, mark); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// settle moves pending events matching where whose deliveries are all
+// finished to sent, or to failed when any sink gave up on them.
+func settle(tx *sql.Tx, where string, args ...any) error {
+	_, err := tx.Exec(`UPDATE events SET delivery_state = CASE
+            WHEN EXISTS (SELECT 1 FROM deliveries WHERE event_id = events.id AND state = ?) THEN ?
+            ELSE ? END
+        WHERE delivery_state = ? AND `+where+`
+            AND NOT EXISTS (SELECT 1 FROM deliveries WHERE event_id = events.id AND state = ?)`,
+		append([]any{DeliveryFailed, DeliveryFailed, DeliverySent, DeliveryPending}, append(args, DeliveryPending)...)...)
+	return err
+}
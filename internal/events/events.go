@@ -2,15 +2,99 @@ package events
 
 import "time"
 
+// Delivery states tracked per sink delivery and, aggregated over an event's
+// sinks, per stored event: an event is sent once every sink took it and failed
+// if any sink gave up on it.
+const (
+	DeliveryPending = "pending"
+	DeliverySent    = "sent"
+	DeliveryFailed  = "failed"
+)
+
+// Event severities, lowest to highest.
+const (
+	SeverityInfo     = "info"
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+// SeverityRank orders severities from 0 (info) to 4 (critical). Unknown
+// values rank as info.
+func SeverityRank(s string) int {
+	switch s {
+	case SeverityLow:
+		return 1
+	case SeverityMedium:
+		return 2
+	case SeverityHigh:
+		return 3
+	case SeverityCritical:
+		return 4
+	}
+	return 0
+}
+
+// SchemaVersion is the envelope version stamped on events written by this agent.
+// Rows stored before the envelope fields existed read back as version 1.
+const SchemaVersion = 2
+
 type Event struct {
-	ID        int64     `json:"id"`
-	Timestamp time.Time `json:"timestamp"`
-	Type      string    `json:"type"`
-	Payload   string    `json:"payload"`
+	ID            int64     `json:"id"`
+	Timestamp     time.Time `json:"timestamp"`
+	Type          string    `json:"type"`
+	Severity      string    `json:"severity"`
+	Module        string    `json:"module,omitempty"`
+	AgentID       string    `json:"agent_id,omitempty"`
+	Hostname      string    `json:"hostname,omitempty"`
+	SchemaVersion int       `json:"schema_version"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Payload       string    `json:"payload"`
+	// UploadSequence is the upload sequence already assigned to the event's
+	// pending delivery (see Pending), or 0 when it has not been sent under one.
+	UploadSequence int64 `json:"-"`
+	// ViolationKey names the violation the event alerts for. The alert is
+	// recorded on the violation in the same transaction that stores the event.
+	ViolationKey string `json:"-"`
 }
 
 type EventStore interface {
+	ViolationTracker
 	Save(e Event) error
+	// SaveBatch stores evts atomically and fills in their assigned IDs.
+	SaveBatch(evts []Event) error
 	List(limit int) ([]Event, error)
-	Close() error
+	// Query returns one page of events matching q.
+	Query(q Query) (Page, error)
+	// Count returns how many events match q, ignoring its cursor and limit.
+	Count(q Query) (int64, error)
+	// Search returns full-text matches for text among events matching q, best first.
+	Search(text string, q Query) ([]SearchResult, error)
+	// Dispatch routes up to limit newly stored events to the sinks named by
+	// route and returns how many were routed; it is safe to call concurrently.
+	Dispatch(route func(Event) []string, limit int) (int, error)
+	// Pending returns events awaiting delivery to sink that are due at now, oldest first.
+	Pending(sink string, limit int, now time.Time) ([]Event, error)
+	// MarkSent records successful delivery of the given events to sink.
+	MarkSent(sink string, ids []int64) error
+	// MarkRetry records a failed delivery attempt to sink and schedules the next one at next.
+	// Deliveries that reach maxAttempts (when > 0) are moved to the failed state.
+	MarkRetry(sink string, ids []int64, next time.Time, maxAttempts int) error
+	// MarkFailed gives up on delivering the given events to sink, e.g. because it rejected them.
+	MarkFailed(sink string, ids []int64) error
+	// Redeliver queues events stored since the given time for delivery to sink again.
+	Redeliver(sink string, since time.Time) (int64, error)
+	// AssignSequence takes the next value of counter as the upload sequence of
+	// sink's deliveries of ids, so a retry resends them under the same number.
+	AssignSequence(sink, counter string, ids []int64) (int64, error)
+	// ReleaseSequence clears the upload sequence of sink's deliveries of ids once
+	// the gateway has answered for it; anything resent later gets a new number.
+	ReleaseSequence(sink string, ids []int64) error
+	// AbandonSinks fails pending deliveries to every sink not in keep.
+	AbandonSinks(keep []string) (int64, error)
+	// Prune deletes events that fall outside the retention policy.
+	Prune(p RetentionPolicy, now time.Time) (PruneResult, error)
+	// VerifyChain checks the tamper-evident hash chain over all stored events.
+	VerifyChain() (ChainReport, error)
 }
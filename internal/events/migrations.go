@@ -0,0 +1,268 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"sentinel-agent/internal/migrate"
+)
+
+// migrations is the ordered schema history of the events table. Append only.
+var migrations = []migrate.Migration{
+	{Version: 1, Name: "create_events", Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS events (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            timestamp TEXT NOT NULL,
+            type TEXT NOT NULL,
+            payload TEXT NOT NULL
+        );`)
+		return err
+	}},
+	{Version: 2, Name: "delivery_state", Up: func(tx *sql.Tx) error {
+		// rows written before the outbox existed were already offered to the
+		// gateway once, so treat them as sent
+		added, err := migrate.AddColumn(tx, "events", "delivery_state", `TEXT NOT NULL DEFAULT 'pending'`)
+		if err != nil {
+			return err
+		}
+		if added {
+			if _, err := tx.Exec(`UPDATE events SET delivery_state = ?`, DeliverySent); err != nil {
+				return err
+			}
+		}
+		if _, err := migrate.AddColumn(tx, "events", "attempts", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		if _, err := migrate.AddColumn(tx, "events", "next_attempt", `TEXT`); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_events_delivery ON events(delivery_state, id);`)
+		return err
+	}},
+	{Version: 3, Name: "module_and_query_indexes", Up: func(tx *sql.Tx) error {
+		if _, err := migrate.AddColumn(tx, "events", "module", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_events_type ON events(type, id);
+            CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);`)
+		return err
+	}},
+	{Version: 4, Name: "envelope", Up: func(tx *sql.Tx) error {
+		for _, c := range []struct{ name, decl string }{
+			{"severity", `TEXT NOT NULL DEFAULT 'info'`},
+			{"agent_id", `TEXT NOT NULL DEFAULT ''`},
+			{"hostname", `TEXT NOT NULL DEFAULT ''`},
+			{"schema_version", `INTEGER NOT NULL DEFAULT 1`},
+			{"correlation_id", `TEXT NOT NULL DEFAULT ''`},
+		} {
+			if _, err := migrate.AddColumn(tx, "events", c.name, c.decl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{Version: 5, Name: "events_fts", Up: func(tx *sql.Tx) error {
+		// external-content index kept in sync by triggers, so inserts and
+		// retention deletes update it without any store code
+		_, err := tx.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS events_fts USING fts5(
+                type, payload, content='events', content_rowid='id'
+            );
+            CREATE TRIGGER IF NOT EXISTS events_fts_insert AFTER INSERT ON events BEGIN
+                INSERT INTO events_fts(rowid, type, payload) VALUES (new.id, new.type, new.payload);
+            END;
+            CREATE TRIGGER IF NOT EXISTS events_fts_delete AFTER DELETE ON events BEGIN
+                INSERT INTO events_fts(events_fts, rowid, type, payload) VALUES ('delete', old.id, old.type, old.payload);
+            END;
+            CREATE TRIGGER IF NOT EXISTS events_fts_update AFTER UPDATE OF type, payload ON events BEGIN
+                INSERT INTO events_fts(events_fts, rowid, type, payload) VALUES ('delete', old.id, old.type, old.payload);
+                INSERT INTO events_fts(rowid, type, payload) VALUES (new.id, new.type, new.payload);
+            END;
+            INSERT INTO events_fts(events_fts) VALUES ('rebuild');`)
+		return err
+	}},
+	{Version: 6, Name: "violations", Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS violations (
+                key TEXT PRIMARY KEY,
+                policy_id TEXT NOT NULL,
+                rule_id TEXT NOT NULL,
+                process_name TEXT NOT NULL,
+                pid INTEGER NOT NULL,
+                process_started INTEGER NOT NULL,
+                first_seen TEXT NOT NULL,
+                last_seen TEXT NOT NULL,
+                last_alert TEXT NOT NULL,
+                count INTEGER NOT NULL,
+                open INTEGER NOT NULL DEFAULT 1
+            );
+            CREATE INDEX IF NOT EXISTS idx_violations_open ON violations(open, last_seen);`)
+		return err
+	}},
+	{Version: 7, Name: "hash_chain", Up: func(tx *sql.Tx) error {
+		if _, err := migrate.AddColumn(tx, "events", "prev_hash", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := migrate.AddColumn(tx, "events", "hash", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS chain_anchors (
+                event_id INTEGER PRIMARY KEY,
+                prev_hash TEXT NOT NULL,
+                created TEXT NOT NULL
+            );
+            CREATE TABLE IF NOT EXISTS chain_state (
+                id INTEGER PRIMARY KEY CHECK (id = 1),
+                head TEXT NOT NULL
+            );`); err != nil {
+			return err
+		}
+		// chain the rows that already exist, oldest first
+		rows, err := tx.Query(`SELECT id, timestamp, type, payload FROM events ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		type link struct {
+			id         int64
+			prev, hash string
+		}
+		links := []link{}
+		prev := ""
+		for rows.Next() {
+			var id int64
+			var ts, typ, payload string
+			if err := rows.Scan(&id, &ts, &typ, &payload); err != nil {
+				rows.Close()
+				return err
+			}
+			h := chainHash(prev, ts, typ, payload)
+			links = append(links, link{id, prev, h})
+			prev = h
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		rows.Close()
+		for _, l := range links {
+			if _, err := tx.Exec(`UPDATE events SET prev_hash = ?, hash = ? WHERE id = ?`, l.prev, l.hash, l.id); err != nil {
+				return err
+			}
+		}
+		return setChainHead(tx, prev)
+	}},
+	{Version: 8, Name: "counters", Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS counters (
+                name TEXT PRIMARY KEY,
+                value INTEGER NOT NULL
+            );`)
+		return err
+	}},
+	{Version: 9, Name: "deliveries", Up: func(tx *sql.Tx) error {
+		// delivery is tracked per sink from here on; events.delivery_state
+		// becomes the aggregate over an event's deliveries
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS deliveries (
+                sink TEXT NOT NULL,
+                event_id INTEGER NOT NULL,
+                state TEXT NOT NULL DEFAULT 'pending',
+                attempts INTEGER NOT NULL DEFAULT 0,
+                next_attempt TEXT,
+                PRIMARY KEY (sink, event_id)
+            );
+            CREATE INDEX IF NOT EXISTS idx_deliveries_pending ON deliveries(sink, state, event_id);
+            CREATE INDEX IF NOT EXISTS idx_deliveries_event ON deliveries(event_id);
+            CREATE TRIGGER IF NOT EXISTS events_deliveries_delete AFTER DELETE ON events BEGIN
+                DELETE FROM deliveries WHERE event_id = old.id;
+            END;
+            ALTER TABLE events DROP COLUMN attempts;
+            ALTER TABLE events DROP COLUMN next_attempt;`)
+		return err
+	}},
+	{Version: 10, Name: "violation_policy_version", Up: func(tx *sql.Tx) error {
+		_, err := migrate.AddColumn(tx, "violations", "policy_version", `INTEGER NOT NULL DEFAULT 0`)
+		return err
+	}},
+	{Version: 11, Name: "delivery_sequence", Up: func(tx *sql.Tx) error {
+		_, err := migrate.AddColumn(tx, "deliveries", "sequence", `INTEGER NOT NULL DEFAULT 0`)
+		return err
+	}},
+	{Version: 12, Name: "announce_anchors", Up: func(tx *sql.Tx) error {
+		// anchors are only trusted once an events_pruned event lists them;
+		// record the ones left by earlier versions in the chain
+		anchors, err := chainAnchors(tx)
+		if err != nil || len(anchors) == 0 {
+			return err
+		}
+		head, err := chainHead(tx)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(PruneResult{Reasons: map[string]int64{}, Types: map[string]int64{}, ChainHead: head, Anchored: anchors})
+		if err != nil {
+			return err
+		}
+		ts := time.Now().UTC().Format(time.RFC3339)
+		hash := chainHash(head, ts, "events_pruned", string(b))
+		if _, err := tx.Exec(`INSERT INTO events(timestamp, type, module, schema_version, payload, prev_hash, hash)
+            VALUES (?, 'events_pruned', 'retention', ?, ?, ?, ?)`, ts, SchemaVersion, string(b), head, hash); err != nil {
+			return err
+		}
+		return setChainHead(tx, hash)
+	}},
+	{Version: 13, Name: "utc_timestamps", Up: func(tx *sql.Tx) error {
+		// rows written before events were stored in UTC carry the local
+		// offset, which breaks text comparison of timestamps. The hash chain
+		// covers the timestamp, so the links of rewritten rows are recomputed;
+		// a row whose hash did not verify is left alone, as is the prev_hash
+		// after a pruned gap, which names a deleted event.
+		rows, err := tx.Query(`SELECT id, timestamp, type, payload, prev_hash, hash FROM events ORDER BY id`)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id                   int64
+			ts, prev, hash       string
+			newTS, newPrev, newH string
+		}
+		var changed []row
+		lastOld, lastNew := "", ""
+		for rows.Next() {
+			var r row
+			var typ, payload string
+			if err := rows.Scan(&r.id, &r.ts, &typ, &payload, &r.prev, &r.hash); err != nil {
+				rows.Close()
+				return err
+			}
+			r.newTS, r.newPrev, r.newH = r.ts, r.prev, r.hash
+			if t, err := time.Parse(time.RFC3339, r.ts); err == nil {
+				r.newTS = t.UTC().Format(time.RFC3339)
+			}
+			if r.prev == lastOld {
+				r.newPrev = lastNew
+			}
+			if chainHash(r.prev, r.ts, typ, payload) == r.hash {
+				r.newH = chainHash(r.newPrev, r.newTS, typ, payload)
+			} else {
+				r.newTS, r.newPrev = r.ts, r.prev
+			}
+			if r.newTS != r.ts || r.newH != r.hash {
+				changed = append(changed, r)
+			}
+			lastOld, lastNew = r.hash, r.newH
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return err
+		}
+		rows.Close()
+		for _, r := range changed {
+			if _, err := tx.Exec(`UPDATE events SET timestamp = ?, prev_hash = ?, hash = ? WHERE id = ?`, r.newTS, r.newPrev, r.newH, r.id); err != nil {
+				return err
+			}
+		}
+		head, err := chainHead(tx)
+		if err != nil || head != lastOld || lastOld == lastNew {
+			return err
+		}
+		return setChainHead(tx, lastNew)
+	}},
+}
@@ -0,0 +1,133 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Direction selects which way a query pages through events by id.
+type Direction int
+
+const (
+	// Backward returns newest events first, with ids below the cursor (or the newest when the cursor is 0).
+	Backward Direction = iota
+	// Forward returns oldest events first, with ids above the cursor.
+	Forward
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+)
+
+var fieldPath = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// Query filters stored events. Zero-valued fields do not filter.
+type Query struct {
+	Types  []string
+	Module string
+	Since  time.Time // inclusive
+	Until  time.Time // exclusive
+	// Fields matches top-level or dotted payload JSON fields by their string value.
+	Fields    map[string]string
+	Cursor    int64
+	Direction Direction
+	Limit     int
+}
+
+// Page is one page of query results. Next continues in the query's direction and
+// Prev pages back the other way; either is 0 when there is nothing to page to.
+type Page struct {
+	Events []Event `json:"events"`
+	Next   int64   `json:"next,omitempty"`
+	Prev   int64   `json:"prev,omitempty"`
+}
+
+// where builds the filter clause for q, optionally including the cursor bound.
+// Columns are qualified so the clause also works when events is joined.
+func (q Query) where(withCursor bool) (string, []any, error) {
+	conds := []string{"1=1"}
+	args := []any{}
+	if len(q.Types) > 0 {
+		conds = append(conds, "events.type IN ("+strings.TrimSuffix(strings.Repeat("?,", len(q.Types)), ",")+")")
+		for _, t := range q.Types {
+			args = append(args, t)
+		}
+	}
+	if q.Module != "" {
+		conds = append(conds, "events.module = ?")
+		args = append(args, q.Module)
+	}
+	if !q.Since.IsZero() {
+		conds = append(conds, "events.timestamp >= ?")
+		args = append(args, q.Since.UTC().Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		conds = append(conds, "events.timestamp < ?")
+		args = append(args, q.Until.UTC().Format(time.RFC3339))
+	}
+	for k, v := range q.Fields {
+		if !fieldPath.MatchString(k) {
+			return "", nil, fmt.Errorf("invalid payload field %q", k)
+		}
+		conds = append(conds, "CAST(json_extract(events.payload, ?) AS TEXT) = ?")
+		args = append(args, "$."+k, v)
+	}
+	if withCursor && q.Cursor > 0 {
+		if q.Direction == Forward {
+			conds = append(conds, "events.id > ?")
+		} else {
+			conds = append(conds, "events.id < ?")
+		}
+		args = append(args, q.Cursor)
+	}
+	return strings.Join(conds, " AND "), args, nil
+}
+
+func (s *sqliteStore) Query(q Query) (Page, error) {
+	where, args, err := q.where(true)
+	if err != nil {
+		return Page{}, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+	order := "DESC"
+	if q.Direction == Forward {
+		order = "ASC"
+	}
+	rows, err := s.db.Query(`SELECT `+eventColumns+` FROM events WHERE `+where+` ORDER BY id `+order+` LIMIT ?`, append(args, limit+1)...)
+	if err != nil {
+		return Page{}, err
+	}
+	defer rows.Close()
+	evts, err := scanEvents(rows)
+	if err != nil {
+		return Page{}, err
+	}
+	page := Page{Events: evts}
+	if len(evts) > limit {
+		page.Events = evts[:limit]
+		page.Next = page.Events[limit-1].ID
+	}
+	if q.Cursor > 0 && len(page.Events) > 0 {
+		page.Prev = page.Events[0].ID
+	}
+	return page, nil
+}
+
+func (s *sqliteStore) Count(q Query) (int64, error) {
+	where, args, err := q.where(false)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = s.db.QueryRow(`SELECT COUNT(*) FROM events WHERE `+where, args...).Scan(&n)
+	return n, err
+}
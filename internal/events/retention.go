@@ -0,0 +1,206 @@
+package events
+
+import (
+	"database/sql"
+	"time"
+)
+
+// RetentionPolicy bounds how much history Prune keeps. Zero values disable a limit.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxRows  int64
+	MaxBytes int64
+	TypeTTL  map[string]time.Duration
+}
+
+// PruneResult records how many events were dropped, by reason and by event type.
+type PruneResult struct {
+	Total   int64            `json:"total"`
+	Reasons map[string]int64 `json:"reasons"`
+	Types   map[string]int64 `json:"types"`
+	// Anchors counts the hash-chain anchors recorded over pruned gaps and
+	// ChainHead is the chain head after pruning, as a checkpoint.
+	Anchors   int64  `json:"anchors"`
+	ChainHead string `json:"chain_head,omitempty"`
+	// Anchored lists every anchor in place after pruning. Recorded in the
+	// events_pruned event it puts the anchors in the chain themselves, which
+	// VerifyChain requires before it accepts an anchor.
+	Anchored []Anchor `json:"anchored,omitempty"`
+}
+
+func (r *PruneResult) add(reason string, d deleted) {
+	r.Anchors += d.anchors
+	for t, n := range d.types {
+		r.Total += n
+		r.Reasons[reason] += n
+		r.Types[t] += n
+	}
+}
+
+// Prune deletes events outside the retention policy. Age limits apply to every
+// event; row and size limits drop already-delivered events before undelivered ones.
+func (s *sqliteStore) Prune(p RetentionPolicy, now time.Time) (PruneResult, error) {
+	res := PruneResult{Reasons: map[string]int64{}, Types: map[string]int64{}}
+	for typ, ttl := range p.TypeTTL {
+		if ttl <= 0 {
+			continue
+		}
+		n, err := s.deleteWhere(`type = ? AND timestamp < ?`, typ, cutoff(now, ttl))
+		if err != nil {
+			return res, err
+		}
+		res.add("type_ttl", n)
+	}
+	if p.MaxAge > 0 {
+		n, err := s.deleteWhere(`timestamp < ?`, cutoff(now, p.MaxAge))
+		if err != nil {
+			return res, err
+		}
+		res.add("max_age", n)
+		// closed violation aggregates age out with the events that reported them
+		if _, err := s.db.Exec(`DELETE FROM violations WHERE open = 0 AND last_seen < ?`, cutoff(now, p.MaxAge)); err != nil {
+			return res, err
+		}
+	}
+	if p.MaxRows > 0 {
+		var count int64
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&count); err != nil {
+			return res, err
+		}
+		if count > p.MaxRows {
+			n, err := s.deleteOldest(count - p.MaxRows)
+			if err != nil {
+				return res, err
+			}
+			res.add("max_rows", n)
+		}
+	}
+	if p.MaxBytes > 0 {
+		// freed pages are reused by later inserts, so bounding the used pages
+		// bounds the file without needing a VACUUM
+		for i := 0; i < 10; i++ {
+			used, err := s.usedBytes()
+			if err != nil {
+				return res, err
+			}
+			if used <= p.MaxBytes {
+				break
+			}
+			var count int64
+			if err := s.db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&count); err != nil {
+				return res, err
+			}
+			if count == 0 {
+				break
+			}
+			n, err := s.deleteOldest(count*(used-p.MaxBytes)/used + 1)
+			if err != nil {
+				return res, err
+			}
+			res.add("max_size", n)
+		}
+	}
+	if res.Total > 0 {
+		head, err := chainHead(s.db)
+		if err != nil {
+			return res, err
+		}
+		res.ChainHead = head
+		if res.Anchored, err = chainAnchors(s.db); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// deleted describes one deletion: per-type counts and anchors recorded.
+type deleted struct {
+	types   map[string]int64
+	anchors int64
+}
+
+// deleteOldest removes n events, delivered ones first, oldest first within each group.
+func (s *sqliteStore) deleteOldest(n int64) (deleted, error) {
+	sent, err := s.deleteWhere(`id IN (SELECT id FROM events WHERE delivery_state = ? ORDER BY id LIMIT ?)`, DeliverySent, n)
+	if err != nil {
+		return sent, err
+	}
+	for _, c := range sent.types {
+		n -= c
+	}
+	if n <= 0 {
+		return sent, nil
+	}
+	rest, err := s.deleteWhere(`id IN (SELECT id FROM events ORDER BY id LIMIT ?)`, n)
+	if err != nil {
+		return sent, err
+	}
+	for t, c := range rest.types {
+		sent.types[t] += c
+	}
+	sent.anchors += rest.anchors
+	return sent, nil
+}
+
+// deleteWhere deletes the events matching where, anchors the hash chain over
+// the gaps it leaves and returns per-type counts of what was removed.
+func (s *sqliteStore) deleteWhere(where string, args ...any) (deleted, error) {
+	d := deleted{types: map[string]int64{}}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return d, err
+	}
+	defer tx.Rollback()
+	ids, err := selectDeleted(tx, d.types, where, args...)
+	if err != nil {
+		return d, err
+	}
+	if len(ids) == 0 {
+		return d, nil
+	}
+	if _, err := tx.Exec(`DELETE FROM events WHERE `+where, args...); err != nil {
+		return d, err
+	}
+	if d.anchors, err = anchorGaps(tx, ids, time.Now()); err != nil {
+		return d, err
+	}
+	return d, tx.Commit()
+}
+
+// selectDeleted returns the ids matching where in ascending order and tallies their types into counts.
+func selectDeleted(tx *sql.Tx, counts map[string]int64, where string, args ...any) ([]int64, error) {
+	rows, err := tx.Query(`SELECT id, type FROM events WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		var typ string
+		if err := rows.Scan(&id, &typ); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		counts[typ]++
+	}
+	return ids, rows.Err()
+}
+
+func (s *sqliteStore) usedBytes() (int64, error) {
+	var pages, free, size int64
+	if err := s.db.QueryRow(`PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow(`PRAGMA freelist_count`).Scan(&free); err != nil {
+		return 0, err
+	}
+	if err := s.db.QueryRow(`PRAGMA page_size`).Scan(&size); err != nil {
+		return 0, err
+	}
+	return (pages - free) * size, nil
+}
+
+func cutoff(now time.Time, age time.Duration) string {
+	return now.Add(-age).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,75 @@
+package events
+
+import (
+	"strings"
+)
+
+// SearchResult is one full-text match. Lower Rank is a better match (bm25).
+type SearchResult struct {
+	Event   Event   `json:"event"`
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// Search runs a full-text query over event types and payloads, restricted by
+// the filters in q, and returns the best matches first. Plain terms are matched
+// as phrases so input such as cmd.exe, 10.0.0.1 or C:\Windows works as typed;
+// a query containing double quotes is passed to FTS5 unchanged.
+func (s *sqliteStore) Search(text string, q Query) ([]SearchResult, error) {
+	where, args, err := q.where(false)
+	if err != nil {
+		return nil, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+	args = append([]any{ftsQuery(text)}, args...)
+	rows, err := s.db.Query(`SELECT `+qualify("events")+`, bm25(events_fts),
+            snippet(events_fts, -1, '**', '**', '...', 16)
+        FROM events_fts JOIN events ON events.id = events_fts.rowid
+        WHERE events_fts MATCH ? AND `+where+`
+        ORDER BY bm25(events_fts), events.id DESC LIMIT ?`, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []SearchResult{}
+	for rows.Next() {
+		var r SearchResult
+		if err := scanEvent(rows, &r.Event, &r.Rank, &r.Snippet); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// ftsQuery quotes each whitespace-separated term as an FTS5 phrase, keeping a
+// trailing * as a prefix match.
+func ftsQuery(text string) string {
+	if strings.Contains(text, `"`) {
+		return text
+	}
+	terms := strings.Fields(text)
+	for i, t := range terms {
+		if strings.HasSuffix(t, "*") && len(t) > 1 {
+			terms[i] = `"` + strings.TrimSuffix(t, "*") + `"*`
+		} else {
+			terms[i] = `"` + t + `"`
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// qualify prefixes every column in eventColumns with table.
+func qualify(table string) string {
+	cols := strings.Split(eventColumns, ", ")
+	for i, c := range cols {
+		cols[i] = table + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
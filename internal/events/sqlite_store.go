@@ -2,61 +2,124 @@ package events
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"sentinel-agent/internal/migrate"
 )
 
+const eventColumns = `id, timestamp, type, severity, module, agent_id, hostname, schema_version, correlation_id, payload`
+
 type sqliteStore struct {
 	db *sql.DB
 }
 
-func NewSqliteStore(path string) (EventStore, error) {
-	db, err := sql.Open("sqlite", path+"?_foreign_keys=1")
-	if err != nil {
-		return nil, err
-	}
-	if err := createSchema(db); err != nil {
-		db.Close()
+// NewSqliteStore migrates the events table on db, which is owned by the caller
+// (normally storage.DB) and shared with the policy store.
+func NewSqliteStore(db *sql.DB) (EventStore, error) {
+	if err := migrate.Run(db, "events", migrations); err != nil {
 		return nil, err
 	}
 	return &sqliteStore{db: db}, nil
 }
 
-func createSchema(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS events (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
-        timestamp TEXT NOT NULL,
-        type TEXT NOT NULL,
-        payload TEXT NOT NULL
-    );`)
-	return err
-}
-
 func (s *sqliteStore) Save(e Event) error {
-	_, err := s.db.Exec(`INSERT INTO events(timestamp, type, payload) VALUES (?, ?, ?)`, e.Timestamp.Format(time.RFC3339), e.Type, e.Payload)
-	return err
+	return s.SaveBatch([]Event{e})
 }
 
-func (s *sqliteStore) List(limit int) ([]Event, error) {
-	rows, err := s.db.Query(`SELECT id, timestamp, type, payload FROM events ORDER BY id DESC LIMIT ?`, limit)
+// SaveBatch inserts evts in a single transaction and sets each event's ID to
+// the row id it was assigned. Either all events are stored or none are.
+func (s *sqliteStore) SaveBatch(evts []Event) error {
+	if len(evts) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer tx.Rollback()
+	prev, err := chainHead(tx)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO events(timestamp, type, severity, module, agent_id, hostname, schema_version, correlation_id, payload, prev_hash, hash)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	ids := make([]int64, len(evts))
+	for i := range evts {
+		e := &evts[i]
+		if e.Severity == "" {
+			e.Severity = SeverityInfo
+		}
+		if e.SchemaVersion == 0 {
+			e.SchemaVersion = SchemaVersion
+		}
+		ts := e.Timestamp.UTC().Format(time.RFC3339)
+		hash := chainHash(prev, ts, e.Type, e.Payload)
+		res, err := stmt.Exec(ts, e.Type, e.Severity, e.Module,
+			e.AgentID, e.Hostname, e.SchemaVersion, e.CorrelationID, e.Payload, prev, hash)
+		if err != nil {
+			return err
+		}
+		if ids[i], err = res.LastInsertId(); err != nil {
+			return err
+		}
+		if e.ViolationKey != "" {
+			if _, err := tx.Exec(`UPDATE violations SET last_alert = ? WHERE key = ?`, ts, e.ViolationKey); err != nil {
+				return err
+			}
+		}
+		prev = hash
+	}
+	if err := setChainHead(tx, prev); err != nil {
+		return err
 	}
-	defer rows.Close()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for i := range evts {
+		evts[i].ID = ids[i]
+	}
+	return nil
+}
+
+func (s *sqliteStore) List(limit int) ([]Event, error) {
+	page, err := s.Query(Query{Limit: limit})
+	return page.Events, err
+}
+
+func scanEvents(rows *sql.Rows) ([]Event, error) {
 	out := []Event{}
 	for rows.Next() {
-		var id int64
-		var ts string
-		var typ string
-		var payload string
-		if err := rows.Scan(&id, &ts, &typ, &payload); err != nil {
+		var e Event
+		if err := scanEvent(rows, &e); err != nil {
 			return nil, err
 		}
-		t, _ := time.Parse(time.RFC3339, ts)
-		out = append(out, Event{ID: id, Timestamp: t, Type: typ, Payload: payload})
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// scanEvent scans a row selected with eventColumns into e, followed by any extra columns.
+func scanEvent(rows *sql.Rows, e *Event, extra ...any) error {
+	var ts string
+	dest := append([]any{&e.ID, &ts, &e.Type, &e.Severity, &e.Module, &e.AgentID, &e.Hostname,
+		&e.SchemaVersion, &e.CorrelationID, &e.Payload}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return err
 	}
-	return out, nil
+	e.Timestamp, _ = time.Parse(time.RFC3339, ts)
+	return nil
 }
 
-func (s *sqliteStore) Close() error { return s.db.Close() }
+// inArgs returns a placeholder list and matching arguments for an IN clause.
+func inArgs(ids []int64) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","), args
+}
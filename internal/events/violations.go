@@ -0,0 +1,113 @@
+package events
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Violation aggregates repeated sightings of one rule matching one process
+// instance, so the enforcer can alert once instead of every poll cycle.
+type Violation struct {
+	Key            string    `json:"-"`
+	PolicyID       string    `json:"policy_id"`
+	PolicyVersion  int64     `json:"policy_version"` // revision of the policy that last matched
+	RuleID         string    `json:"rule_id"`
+	ProcessName    string    `json:"process_name"`
+	PID            int32     `json:"pid"`
+	ProcessStarted int64     `json:"process_started"` // process create time, ms since epoch
+	FirstSeen      time.Time `json:"first_seen"`
+	LastSeen       time.Time `json:"last_seen"`
+	LastAlert      time.Time `json:"last_alert"`
+	Count          int64     `json:"count"`
+	Open           bool      `json:"open"`
+}
+
+// ViolationTracker persists violation aggregates across poll cycles and restarts.
+type ViolationTracker interface {
+	// ObserveViolation records a sighting of v at now and returns the updated
+	// record. first is true when the violation is new or was previously closed.
+	// LastAlert stays zero until an event carrying the violation's key
+	// (Event.ViolationKey) is saved.
+	ObserveViolation(v Violation, now time.Time) (rec Violation, first bool, err error)
+	// OpenViolations returns every violation that has not been closed.
+	OpenViolations() ([]Violation, error)
+	// CloseViolation marks a violation as over, e.g. because the process exited.
+	CloseViolation(key string) error
+}
+
+const violationColumns = `key, policy_id, policy_version, rule_id, process_name, pid, process_started, first_seen, last_seen, last_alert, count, open`
+
+func (s *sqliteStore) ObserveViolation(v Violation, now time.Time) (Violation, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return v, false, err
+	}
+	defer tx.Rollback()
+	ts := now.UTC().Format(time.RFC3339)
+	cur, err := scanViolation(tx.QueryRow(`SELECT `+violationColumns+` FROM violations WHERE key = ?`, v.Key))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec(`INSERT INTO violations(`+violationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, '', 1, 1)`,
+			v.Key, v.PolicyID, v.PolicyVersion, v.RuleID, v.ProcessName, v.PID, v.ProcessStarted, ts, ts)
+		if err != nil {
+			return v, false, err
+		}
+		v.FirstSeen, v.LastSeen, v.Count, v.Open = now, now, 1, true
+		return v, true, tx.Commit()
+	case err != nil:
+		return v, false, err
+	case !cur.Open:
+		// same process matched again after the violation was closed: start over
+		_, err = tx.Exec(`UPDATE violations SET policy_version = ?, first_seen = ?, last_seen = ?, last_alert = '', count = 1, open = 1 WHERE key = ?`,
+			v.PolicyVersion, ts, ts, v.Key)
+		if err != nil {
+			return v, false, err
+		}
+		cur.PolicyVersion = v.PolicyVersion
+		cur.FirstSeen, cur.LastSeen, cur.LastAlert, cur.Count, cur.Open = now, now, time.Time{}, 1, true
+		return cur, true, tx.Commit()
+	}
+	if _, err := tx.Exec(`UPDATE violations SET policy_version = ?, last_seen = ?, count = count + 1 WHERE key = ?`, v.PolicyVersion, ts, v.Key); err != nil {
+		return v, false, err
+	}
+	cur.PolicyVersion = v.PolicyVersion
+	cur.LastSeen = now
+	cur.Count++
+	return cur, false, tx.Commit()
+}
+
+func (s *sqliteStore) OpenViolations() ([]Violation, error) {
+	rows, err := s.db.Query(`SELECT ` + violationColumns + ` FROM violations WHERE open = 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Violation{}
+	for rows.Next() {
+		v, err := scanViolation(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) CloseViolation(key string) error {
+	_, err := s.db.Exec(`UPDATE violations SET open = 0 WHERE key = ?`, key)
+	return err
+}
+
+func scanViolation(row interface{ Scan(...any) error }) (Violation, error) {
+	var v Violation
+	var first, last, alert string
+	err := row.Scan(&v.Key, &v.PolicyID, &v.PolicyVersion, &v.RuleID, &v.ProcessName, &v.PID, &v.ProcessStarted, &first, &last, &alert, &v.Count, &v.Open)
+	if err != nil {
+		return v, err
+	}
+	v.FirstSeen, _ = time.Parse(time.RFC3339, first)
+	v.LastSeen, _ = time.Parse(time.RFC3339, last)
+	v.LastAlert, _ = time.Parse(time.RFC3339, alert)
+	return v, nil
+}
@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned for batches that were not sent because the
+// circuit is open. The events were not attempted and should simply wait until Until.
+type CircuitOpenError struct {
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("gateway circuit open until %s", e.Until.UTC().Format(time.RFC3339))
+}
+
+// StatusError is an HTTP error status from the gateway, with the delay it
+// asked for in Retry-After, if any.
+type StatusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("gateway returned status %d", e.Code)
+}
+
+// StateChange describes the circuit opening (the gateway became unreachable)
+// or closing again.
+type StateChange struct {
+	URL      string
+	Open     bool
+	Failures int
+	Err      string
+	// Until is when the next attempt is allowed, set when the circuit opens.
+	Until time.Time
+	// Down is how long the gateway was unreachable, set when the circuit closes.
+	Down time.Duration
+}
+
+// StateNotifier is implemented by clients that report circuit state changes.
+type StateNotifier interface {
+	OnStateChange(fn func(StateChange))
+}
+
+// probeWait is how long callers are held off while a probe is in flight.
+const probeWait = time.Second
+
+// breaker opens after threshold consecutive failures, or straight away when
+// the gateway asks for a pause with Retry-After, and lets one probe through
+// once the cooldown has passed (half-open). Other callers keep being refused
+// until the probe's outcome closes the circuit or opens it again; the cooldown
+// doubles each time a probe fails.
+type breaker struct {
+	mu          sync.Mutex
+	url         string
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	failures    int
+	trips       int
+	open        bool
+	probing     bool
+	since       time.Time
+	until       time.Time
+	notify      func(StateChange)
+}
+
+// allow reports whether a request may be sent at now, and whether it is the
+// probe: once the cooldown has passed the first caller probes.
+func (b *breaker) allow(now time.Time) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case !b.open:
+		return false, nil
+	case now.Before(b.until):
+		return false, &CircuitOpenError{Until: b.until}
+	case b.probing:
+		return false, &CircuitOpenError{Until: now.Add(probeWait)}
+	}
+	b.probing = true
+	return true, nil
+}
+
+// release ends a probe whose outcome said nothing about the gateway, such as
+// a cancelled request, so the next caller probes instead.
+func (b *breaker) release() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *breaker) success(now time.Time) {
+	b.mu.Lock()
+	b.failures, b.trips, b.probing = 0, 0, false
+	if !b.open {
+		b.mu.Unlock()
+		return
+	}
+	b.open = false
+	c := StateChange{URL: b.url, Down: now.Sub(b.since)}
+	fn := b.notify
+	b.mu.Unlock()
+	if fn != nil {
+		fn(c)
+	}
+}
+
+func (b *breaker) failure(now time.Time, err error, retryAfter time.Duration) {
+	b.mu.Lock()
+	b.failures++
+	b.probing = false
+	var wait time.Duration
+	switch {
+	case retryAfter > 0:
+		wait = min(retryAfter, b.maxCooldown)
+	case b.open || (b.threshold > 0 && b.failures >= b.threshold):
+		b.trips++
+		wait = b.cooldown
+		for i := 1; i < b.trips && wait < b.maxCooldown; i++ {
+			wait *= 2
+		}
+		wait = min(wait, b.maxCooldown)
+	default:
+		b.mu.Unlock()
+		return
+	}
+	b.until = now.Add(wait)
+	if b.open {
+		// a failed probe; stay open for longer
+		b.mu.Unlock()
+		return
+	}
+	b.open, b.since = true, now
+	c := StateChange{URL: b.url, Open: true, Failures: b.failures, Err: err.Error(), Until: b.until}
+	fn := b.notify
+	b.mu.Unlock()
+	if fn != nil {
+		fn(c)
+	}
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(h); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
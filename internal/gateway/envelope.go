@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"sentinel-agent/internal/tasks"
+)
+
+// ProtocolVersion is the upload envelope version sent by this agent.
+const ProtocolVersion = 1
+
+// Envelope is the body of an upload request. Sequence increases with every
+// request an agent makes (across restarts) so the gateway can spot replays and
+// gaps and deduplicate retried batches.
+type Envelope struct {
+	Version      int             `json:"version"`
+	AgentID      string          `json:"agent_id"`
+	Hostname     string          `json:"hostname"`
+	AgentVersion string          `json:"agent_version"`
+	Sequence     int64           `json:"sequence"`
+	Events       json.RawMessage `json:"events"`
+}
+
+// Ack is the gateway's response to an upload: which event IDs it stored and
+// which it refused. IDs in neither list were not processed and are retried.
+// Tasks carries any signed instructions queued for the agent.
+type Ack struct {
+	Version  int          `json:"version"`
+	Sequence int64        `json:"sequence"`
+	Accepted []int64      `json:"accepted"`
+	Rejected []Rejection  `json:"rejected"`
+	Tasks    []tasks.Task `json:"tasks,omitempty"`
+}
+
+// Rejection is an event the gateway refused permanently, with its reason.
+type Rejection struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// Sequencer hands out the monotonically increasing upload sequence numbers.
+// A number belongs to one batch of events until the gateway answers for it,
+// so a batch whose ack was lost is resent under the same number and the
+// gateway can recognise the retry.
+type Sequencer interface {
+	// AssignSequence returns a new sequence number for the events ids and records it.
+	AssignSequence(ids []int64) (int64, error)
+	// ReleaseSequence forgets the number recorded for ids after an ack.
+	ReleaseSequence(ids []int64) error
+}
+
+// applyAck fills res from a response body. A response that is not an ack for
+// seq is an error, so the batch is retried rather than assumed stored. With
+// legacy set, for gateways that predate acknowledgements, such a response
+// accepts the whole batch instead.
+func applyAck(res *BatchResult, seq int64, body []byte, legacy bool) error {
+	var ack Ack
+	err := json.Unmarshal(body, &ack)
+	if err == nil && ack.Accepted == nil && ack.Rejected == nil {
+		err = fmt.Errorf("no accepted or rejected events")
+	}
+	if err != nil {
+		if legacy {
+			res.Accepted = res.IDs
+			return nil
+		}
+		return fmt.Errorf("gateway response is not an acknowledgement: %w", err)
+	}
+	if ack.Sequence != seq {
+		return fmt.Errorf("gateway acknowledged sequence %d, sent %d", ack.Sequence, seq)
+	}
+	res.Tasks = ack.Tasks
+	inBatch := make(map[int64]bool, len(res.IDs))
+	for _, id := range res.IDs {
+		inBatch[id] = true
+	}
+	for _, id := range ack.Accepted {
+		if inBatch[id] {
+			res.Accepted = append(res.Accepted, id)
+		}
+	}
+	for _, r := range ack.Rejected {
+		if inBatch[r.ID] {
+			res.Rejected = append(res.Rejected, r)
+		}
+	}
+	return nil
+}
+
+// Unacknowledged returns the batch's event IDs the gateway neither accepted nor rejected.
+func (r BatchResult) Unacknowledged() []int64 {
+	if r.Err != nil {
+		return r.IDs
+	}
+	done := make(map[int64]bool, len(r.Accepted)+len(r.Rejected))
+	for _, id := range r.Accepted {
+		done[id] = true
+	}
+	for _, rj := range r.Rejected {
+		done[rj.ID] = true
+	}
+	var out []int64
+	for _, id := range r.IDs {
+		if !done[id] {
+			out = append(out, id)
+		}
+	}
+	return out
+}
@@ -2,57 +2,305 @@ package gateway
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"time"
 
+	"sentinel-agent/internal/config"
 	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/tasks"
+	"sentinel-agent/internal/transport"
+	"sentinel-agent/internal/version"
 )
 
+// BatchResult is the outcome of one upload request. When Err is set the
+// request failed and none of IDs were acknowledged.
+type BatchResult struct {
+	IDs      []int64
+	Accepted []int64
+	Rejected []Rejection
+	Sequence int64
+	Bytes    int
+	Err      error
+	// Tasks are the server's instructions carried in the response.
+	Tasks []tasks.Task
+}
+
 type GatewayClient interface {
-	SendEvents(ctx context.Context, evts []events.Event) error
+	// SendEvents uploads evts in one or more batches and reports the result of
+	// each. The returned error joins the errors of all failed batches.
+	SendEvents(ctx context.Context, evts []events.Event) ([]BatchResult, error)
 }
 
+// maxResponseBytes caps how much of a gateway response is read.
+const maxResponseBytes = 1 << 20
+
 type httpClient struct {
-	url string
-	c   *http.Client
+	url       string
+	c         *http.Client
+	seq       Sequencer
+	agentID   string
+	hostname  string
+	hmacKey   []byte
+	signedAck bool
+	legacyAck bool
+	maxEvents int
+	maxBytes  int
+	gzip      bool
+	br        *breaker
+	onTasks   func([]tasks.Task)
 }
 
-func NewHTTPClient(url string) GatewayClient {
-	return &httpClient{url: url, c: &http.Client{Timeout: 15 * time.Second}}
+// NewHTTPClient returns a client that uploads to cfg.GatewayURL using c, which
+// carries the transport's TLS and authentication settings, numbering requests
+// from seq. When gateway_hmac_key_file is set every request body is signed
+// and signed responses are verified.
+// The client stops sending while the gateway is unreachable; see breaker.
+func NewHTTPClient(cfg *config.Config, c *http.Client, seq Sequencer) (GatewayClient, error) {
+	h := &httpClient{
+		url:       cfg.GatewayURL,
+		c:         c,
+		seq:       seq,
+		agentID:   cfg.AgentID,
+		maxEvents: cfg.GatewayMaxBatchEvents,
+		maxBytes:  cfg.GatewayMaxBatchKB * 1024,
+		gzip:      !cfg.GatewayDisableCompression,
+		legacyAck: cfg.GatewayLegacyAcks,
+		br: &breaker{
+			url:         cfg.GatewayURL,
+			threshold:   cfg.GatewayBreakerThreshold,
+			cooldown:    time.Duration(cfg.GatewayBreakerCooldownSeconds) * time.Second,
+			maxCooldown: time.Duration(cfg.GatewayBreakerMaxCooldownSeconds) * time.Second,
+		},
+	}
+	if cfg.GatewayHMACKeyFile != "" {
+		key, err := transport.ReadSecret(cfg.GatewayHMACKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("gateway hmac key: %w", err)
+		}
+		h.hmacKey = []byte(key)
+		h.signedAck = cfg.GatewayRequireSignedResponses
+	}
+	h.hostname, _ = os.Hostname()
+	return h, nil
 }
 
-func (h *httpClient) SendEvents(ctx context.Context, evts []events.Event) error {
+func (h *httpClient) SendEvents(ctx context.Context, evts []events.Event) ([]BatchResult, error) {
 	if h.url == "" {
 		// no-op for MVP
-		return nil
+		return nil, nil
 	}
-	payload, err := json.Marshal(evts)
+	batches, err := split(evts, h.maxEvents, h.maxBytes)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	results := make([]BatchResult, 0, len(batches))
+	var errs []error
+	for _, b := range batches {
+		res := BatchResult{IDs: b.ids, Bytes: len(b.body), Sequence: b.seq}
+		probe, err := h.br.allow(time.Now())
+		if res.Err = err; err == nil {
+			res.Err = h.send(ctx, &res, b.body)
+			if probe {
+				// its outcome may not have counted either way
+				h.br.release()
+			}
+		}
+		if res.Err != nil {
+			errs = append(errs, res.Err)
+		}
+		results = append(results, res)
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, nil)
+	return results, errors.Join(errs...)
+}
+
+// OnStateChange registers fn to be called when the circuit opens or closes.
+func (h *httpClient) OnStateChange(fn func(StateChange)) {
+	h.br.mu.Lock()
+	defer h.br.mu.Unlock()
+	h.br.notify = fn
+}
+
+// record feeds the outcome of a request to the breaker. Only failing to reach
+// the gateway, 5xx and 429 count against it; any other response proves it is up.
+func (h *httpClient) record(ctx context.Context, err error) {
+	now := time.Now()
+	var se *StatusError
+	var ue *url.Error
+	switch {
+	case err == nil:
+		h.br.success(now)
+	case errors.As(err, &se):
+		if se.Code == http.StatusTooManyRequests || se.Code >= 500 {
+			h.br.failure(now, err, se.RetryAfter)
+		} else {
+			h.br.success(now)
+		}
+	case ctx.Err() != nil:
+		// shutting down, not a gateway failure
+	case errors.As(err, &ue):
+		h.br.failure(now, err, 0)
+	}
+}
+
+// send uploads one batch under its sequence, numbering it first if it has
+// none yet. Once the gateway answered the number is released.
+func (h *httpClient) send(ctx context.Context, res *BatchResult, evts []byte) error {
+	if res.Sequence == 0 {
+		seq, err := h.seq.AssignSequence(res.IDs)
+		if err != nil {
+			return err
+		}
+		res.Sequence = seq
+	}
+	err := h.post(ctx, res, res.Sequence, evts)
+	h.record(ctx, err)
+	h.deliverTasks(res.Tasks)
+	if err == nil {
+		if rerr := h.seq.ReleaseSequence(res.IDs); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// post uploads one batch of events (a JSON array) wrapped in an Envelope and
+// records the gateway's acknowledgements in res.
+func (h *httpClient) post(ctx context.Context, res *BatchResult, seq int64, evts []byte) error {
+	payload, err := json.Marshal(Envelope{
+		Version:      ProtocolVersion,
+		AgentID:      h.agentID,
+		Hostname:     h.hostname,
+		AgentVersion: version.Version,
+		Sequence:     seq,
+		Events:       evts,
+	})
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Body = http.NoBody
-	// Use a simple POST with payload via Do with Buffer
-	// Construct request manually to include body
-	req, err = http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	body := payload
+	if h.gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if h.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	reqSig := ""
+	if h.hmacKey != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		reqSig = Sign(h.hmacKey, ts, h.agentID, body)
+		req.Header.Set(HeaderTimestamp, ts)
+		req.Header.Set(HeaderAgent, h.agentID)
+		req.Header.Set(HeaderSignature, reqSig)
+	}
 	resp, err := h.c.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("gateway returned status %d", resp.StatusCode)
+		return &StatusError{Code: resp.StatusCode, RetryAfter: retryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	rb, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return err
+	}
+	// a gateway that signs its responses must sign them correctly; unsigned
+	// ones are only refused when gateway_require_signed_responses is set
+	if sig := resp.Header.Get(HeaderSignature); sig != "" && h.hmacKey != nil {
+		if err := VerifyResponse(h.hmacKey, resp.Header.Get(HeaderTimestamp), h.agentID, reqSig, rb, sig, time.Now()); err != nil {
+			return fmt.Errorf("gateway response rejected: %w", err)
+		}
+	} else if h.signedAck {
+		return fmt.Errorf("gateway response rejected: missing signature")
+	}
+	return applyAck(res, seq, rb, h.legacyAck)
+}
+
+type batch struct {
+	ids  []int64
+	body []byte // JSON array of the batch's events
+	seq  int64  // sequence the batch was sent under before, 0 if new
+}
+
+// split groups evts into JSON arrays of at most maxEvents events and maxBytes
+// bytes (before compression). An event larger than maxBytes on its own is sent
+// alone so it cannot hold back the rest of the upload. Events already sent
+// under a sequence are regrouped into that batch, ahead of new ones.
+func split(evts []events.Event, maxEvents, maxBytes int) ([]batch, error) {
+	var out []batch
+	var fresh []events.Event
+	resent := map[int64]int{}
+	for _, e := range evts {
+		if e.UploadSequence == 0 {
+			fresh = append(fresh, e)
+			continue
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := resent[e.UploadSequence]
+		if !ok {
+			i = len(out)
+			resent[e.UploadSequence] = i
+			out = append(out, batch{seq: e.UploadSequence, body: []byte{'['}})
+		} else {
+			out[i].body = append(out[i].body, ',')
+		}
+		out[i].body = append(out[i].body, b...)
+		out[i].ids = append(out[i].ids, e.ID)
+	}
+	for i := range out {
+		out[i].body = append(out[i].body, ']')
+	}
+	var cur batch
+	flush := func() {
+		if len(cur.ids) > 0 {
+			cur.body = append(cur.body, ']')
+			out = append(out, cur)
+		}
+		cur = batch{}
+	}
+	for _, e := range fresh {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		full := maxEvents > 0 && len(cur.ids) >= maxEvents
+		tooBig := maxBytes > 0 && len(cur.body)+len(b)+2 > maxBytes
+		if len(cur.ids) > 0 && (full || tooBig) {
+			flush()
+		}
+		if len(cur.ids) == 0 {
+			cur.body = append(cur.body, '[')
+		} else {
+			cur.body = append(cur.body, ',')
+		}
+		cur.body = append(cur.body, b...)
+		cur.ids = append(cur.ids, e.ID)
 	}
-	return nil
+	flush()
+	return out, nil
 }
@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers carrying the HMAC request/response signature.
+const (
+	HeaderTimestamp = "X-Sentinel-Timestamp"
+	HeaderAgent     = "X-Sentinel-Agent"
+	HeaderSignature = "X-Sentinel-Signature"
+)
+
+// maxSignatureSkew bounds how far a signed timestamp may be from local time.
+const maxSignatureSkew = 5 * time.Minute
+
+// Sign returns the signature header value for body: an HMAC-SHA256 over the
+// timestamp, agent ID and body bytes exactly as sent on the wire.
+func Sign(key []byte, timestamp, agentID string, body []byte) string {
+	return mac(key, body, timestamp, agentID)
+}
+
+// SignResponse signs a gateway response to the request whose signature was
+// reqSig. Binding the request means a captured ack cannot be replayed as the
+// answer to a different upload.
+func SignResponse(key []byte, timestamp, agentID, reqSig string, body []byte) string {
+	return mac(key, body, timestamp, agentID, reqSig)
+}
+
+// Verify checks a signature produced by Sign and rejects timestamps outside
+// maxSignatureSkew of now, so captured messages cannot be replayed later.
+func Verify(key []byte, timestamp, agentID string, body []byte, signature string, now time.Time) error {
+	if err := checkTimestamp(timestamp, now); err != nil {
+		return err
+	}
+	return checkMAC(Sign(key, timestamp, agentID, body), signature)
+}
+
+// VerifyResponse checks a signature produced by SignResponse for the request
+// signed with reqSig.
+func VerifyResponse(key []byte, timestamp, agentID, reqSig string, body []byte, signature string, now time.Time) error {
+	if err := checkTimestamp(timestamp, now); err != nil {
+		return err
+	}
+	return checkMAC(SignResponse(key, timestamp, agentID, reqSig, body), signature)
+}
+
+func mac(key, body []byte, fields ...string) string {
+	m := hmac.New(sha256.New, key)
+	for _, f := range fields {
+		m.Write([]byte(f))
+		m.Write([]byte{'\n'})
+	}
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+func checkTimestamp(timestamp string, now time.Time) error {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid signature timestamp %q", timestamp)
+	}
+	if d := now.Sub(time.Unix(secs, 0)); d > maxSignatureSkew || d < -maxSignatureSkew {
+		return fmt.Errorf("signature timestamp is %s away from local time", d.Round(time.Second))
+	}
+	return nil
+}
+
+func checkMAC(want, signature string) error {
+	if !strings.HasPrefix(signature, "sha256=") || !hmac.Equal([]byte(want), []byte(signature)) {
+		return fmt.Errorf("signature does not verify")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"strconv"
+	"time"
+
+	"sentinel-agent/internal/tasks"
+)
+
+// TaskReceiver is implemented by clients that pass on tasks found in upload responses.
+type TaskReceiver interface {
+	OnTasks(fn func([]tasks.Task))
+}
+
+// SignTask returns the signature for t: Sign over its issue time, the target
+// agent ID and the task's ID, type, expiry and arguments. Binding the agent ID
+// means a task captured from one host cannot be replayed to another.
+func SignTask(key []byte, agentID string, t tasks.Task) string {
+	body := t.ID + "\n" + t.Type + "\n" + strconv.FormatInt(t.Expires, 10) + "\n" + string(t.Args)
+	return Sign(key, strconv.FormatInt(t.Issued, 10), agentID, []byte(body))
+}
+
+// maxTaskAge is how long after it was issued a task is still accepted, so a
+// captured task cannot be replayed once the agent could have forgotten it.
+const maxTaskAge = 24 * time.Hour
+
+// checkTask returns why t must not run, or "" when it is authentic and current.
+// Tasks are only accepted from a gateway that shares an HMAC key with the agent.
+func checkTask(key []byte, agentID string, t tasks.Task, now time.Time) string {
+	issued := time.Unix(t.Issued, 0)
+	switch {
+	case t.ID == "":
+		return "missing task id"
+	case key == nil:
+		return "no gateway hmac key configured"
+	case !hmac.Equal([]byte(SignTask(key, agentID, t)), []byte(t.Signature)):
+		return "signature does not verify"
+	case t.Expires == 0:
+		return "missing expiry"
+	case now.Unix() > t.Expires:
+		return "expired"
+	case now.Sub(issued) > maxTaskAge:
+		return "issued too long ago"
+	case issued.Sub(now) > maxSignatureSkew:
+		return "issued in the future"
+	}
+	return ""
+}
+
+// OnTasks registers fn to receive tasks; call it before the client is used.
+func (h *httpClient) OnTasks(fn func([]tasks.Task)) {
+	h.onTasks = fn
+}
+
+// deliverTasks checks the tasks in an upload response and hands them on,
+// refused ones included so they are recorded.
+func (h *httpClient) deliverTasks(ts []tasks.Task) {
+	if len(ts) == 0 {
+		return
+	}
+	if h.onTasks == nil {
+		return
+	}
+	now := time.Now()
+	for i := range ts {
+		ts[i].Invalid = checkTask(h.hmacKey, h.agentID, ts[i], now)
+	}
+	h.onTasks(ts)
+}
@@ -1,16 +1,19 @@
 package logging
 
 import (
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"sentinel-agent/internal/config"
 )
 
 type Logger struct {
-	l *slog.Logger
+	l     *slog.Logger
+	level *slog.LevelVar
 }
 
 func New(cfg *config.Config) *Logger {
@@ -26,9 +29,38 @@ func New(cfg *config.Config) *Logger {
 			}
 		}
 	}
-	handler := slog.NewJSONHandler(out, &slog.HandlerOptions{AddSource: false})
+	level := new(slog.LevelVar)
+	if cfg != nil {
+		if lv, err := parseLevel(cfg.LogLevel); err == nil {
+			level.Set(lv)
+		}
+	}
+	handler := slog.NewJSONHandler(out, &slog.HandlerOptions{AddSource: false, Level: level})
 	l := slog.New(handler)
-	return &Logger{l: l}
+	return &Logger{l: l, level: level}
+}
+
+// SetLevel changes the minimum level logged (debug, info, warn or error) at runtime.
+func (lg *Logger) SetLevel(name string) error {
+	lv, err := parseLevel(name)
+	if err != nil {
+		return err
+	}
+	lg.level.Set(lv)
+	return nil
+}
+
+func (lg *Logger) Level() string { return strings.ToLower(lg.level.Level().String()) }
+
+func parseLevel(name string) (slog.Level, error) {
+	var lv slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := lv.UnmarshalText([]byte(name)); err != nil {
+		return lv, fmt.Errorf("unknown log level %q", name)
+	}
+	return lv, nil
 }
 
 func (lg *Logger) Info(msg string, args ...any)  { lg.l.Info(msg, args...) }
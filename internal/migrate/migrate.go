@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is one ordered schema change. Up runs inside a transaction together
+// with the bookkeeping row, so a migration is either fully applied or not at all.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+// TooNewError is returned when the database was migrated by a newer agent than this one.
+type TooNewError struct {
+	Component string
+	Have      int
+	Known     int
+}
+
+func (e *TooNewError) Error() string {
+	return fmt.Sprintf("%s schema is at version %d but this agent only knows version %d; refusing to start against a database from a newer agent", e.Component, e.Have, e.Known)
+}
+
+// Run applies the migrations for component that have not been applied yet, in
+// version order. Each component tracks its own versions in schema_migrations.
+func Run(db *sql.DB, component string, migrations []Migration) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        component TEXT NOT NULL,
+        version INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        applied TEXT NOT NULL,
+        PRIMARY KEY (component, version)
+    );`); err != nil {
+		return err
+	}
+	current, err := Version(db, component)
+	if err != nil {
+		return err
+	}
+	latest := 0
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("%s migration %q has version %d, want %d", component, m.Name, m.Version, i+1)
+		}
+		latest = m.Version
+	}
+	if current > latest {
+		return &TooNewError{Component: component, Have: current, Known: latest}
+	}
+	for _, m := range migrations[current:] {
+		if err := apply(db, component, m); err != nil {
+			return fmt.Errorf("%s migration %d (%s): %w", component, m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Version returns the highest applied migration version for component, or 0.
+func Version(db *sql.DB, component string) (int, error) {
+	var v sql.NullInt64
+	err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations WHERE component = ?`, component).Scan(&v)
+	return int(v.Int64), err
+}
+
+func apply(db *sql.DB, component string, m Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.Up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations(component, version, name, applied) VALUES (?, ?, ?, ?)`,
+		component, m.Version, m.Name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddColumn adds a column to table unless it already exists and reports whether
+// it was added. Databases written before migrations existed may already have it.
+func AddColumn(tx *sql.Tx, table, column, decl string) (bool, error) {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
+	return err == nil, err
+}
@@ -12,6 +12,8 @@ import (
 
 type Module interface {
 	Name() string
+	// Run collects the module's events. gc is the default gateway sink, which
+	// is nil when no sink is named "gateway", so a module must check it first.
 	Run(ctx context.Context, cfg *config.Config, store events.EventStore, gc gateway.GatewayClient, log *logging.Logger) ([]events.Event, error)
 }
 
@@ -3,6 +3,8 @@ package modules
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	proc "github.com/shirou/gopsutil/process"
@@ -16,47 +18,167 @@ import (
 
 type policyEnforcer struct {
 	pstore *policy.DBStore
+	// warned holds the id and content hash of every stored policy whose
+	// schema problems were logged, so they are reported once per revision
+	warned map[string]bool
 }
 
-func NewPolicyEnforcer(ps *policy.DBStore) Module { return &policyEnforcer{pstore: ps} }
+func NewPolicyEnforcer(ps *policy.DBStore) Module {
+	return &policyEnforcer{pstore: ps, warned: map[string]bool{}}
+}
 
 func (m *policyEnforcer) Name() string { return "policy_enforcer" }
 
+// Run matches running processes against every active policy. Repeated matches of
+// the same rule and process instance are aggregated in the store: an event is
+// emitted on first sighting, again every violation_realert_seconds, and once
+// more when the violation ends. Dry-run policies report policy_would_match
+// instead and never keep another policy from reporting a process.
 func (m *policyEnforcer) Run(ctx context.Context, cfg *config.Config, store events.EventStore, gc gateway.GatewayClient, log *logging.Logger) ([]events.Event, error) {
-	p := m.pstore.Get()
-	if p == nil || p.Raw == "" {
-		return nil, nil
-	}
-	var doc struct {
-		Version int              `json:"version"`
-		Rules   []map[string]any `json:"rules"`
-	}
-	if err := json.Unmarshal([]byte(p.Raw), &doc); err != nil {
-		log.Error("policy parse failed", "err", err)
-		return nil, nil
+	pols, err := m.pstore.Active()
+	if err != nil {
+		return nil, err
 	}
 	procs, err := proc.Processes()
 	if err != nil {
 		return nil, err
 	}
 	now := time.Now().UTC()
+	realert := time.Duration(cfg.ViolationRealertSeconds) * time.Second
 	evts := []events.Event{}
-	for _, r := range doc.Rules {
-		if rt, ok := r["type"].(string); ok && rt == "block_process" {
-			match, _ := r["match"].(string)
-			rid, _ := r["id"].(string)
+	seen := map[string]bool{}
+	alive := map[string]bool{}
+	for _, pr := range procs {
+		started, _ := pr.CreateTime()
+		alive[processKey(pr.Pid, started)] = true
+	}
+	// policies come in precedence order; a process instance is claimed by
+	// the first rule that matches it and lower-precedence rules skip it
+	claimed := map[string]bool{}
+	for _, p := range pols {
+		doc, problems, err := policy.LoadDefinition(p.Raw)
+		if err != nil {
+			log.Error("policy rejected", "id", p.ID, "err", err)
+			continue
+		}
+		if len(problems) > 0 && !m.warned[p.ID+"|"+p.Hash] {
+			m.warned[p.ID+"|"+p.Hash] = true
+			log.Error("stored policy does not match the schema, enforcing its usable rules", "id", p.ID, "err", &policy.ValidationError{Problems: problems})
+		}
+		dry := p.State == policy.StateDryRun
+		typ, prefix := "policy_violation", ""
+		if dry {
+			typ, prefix = "policy_would_match", dryRunPrefix
+		}
+		for _, r := range doc.Rules {
+			if r.Type != policy.RuleBlockProcess {
+				continue
+			}
+			sev := ruleSeverity(r)
+			if dry {
+				sev = events.SeverityInfo
+			}
 			for _, pr := range procs {
 				name, _ := pr.Name()
-				if name == match {
-					payload, _ := json.Marshal(map[string]any{
-						"policy_id": p.ID,
-						"rule_id":   rid,
-						"process":   map[string]any{"name": name, "pid": pr.Pid},
-					})
-					evts = append(evts, events.Event{Timestamp: now, Type: "policy_violation", Payload: string(payload)})
+				if name != r.Match {
+					continue
+				}
+				started, _ := pr.CreateTime()
+				pk := processKey(pr.Pid, started)
+				if !dry {
+					if claimed[pk] {
+						continue
+					}
+					claimed[pk] = true
 				}
+				v := events.Violation{
+					Key:            prefix + p.ID + "|" + r.ID + "|" + pk,
+					PolicyID:       p.ID,
+					PolicyVersion:  p.Revision,
+					RuleID:         r.ID,
+					ProcessName:    name,
+					PID:            pr.Pid,
+					ProcessStarted: started,
+				}
+				seen[v.Key] = true
+				rec, first, err := store.ObserveViolation(v, now)
+				if err != nil {
+					log.Error("violation tracking failed", "err", err)
+					continue
+				}
+				// the alert is recorded when the event is saved, so one that
+				// never got stored is raised again next cycle
+				reason := "first_seen"
+				if !first && !rec.LastAlert.IsZero() {
+					if realert <= 0 || now.Sub(rec.LastAlert) < realert {
+						continue
+					}
+					reason = "realert"
+				}
+				e := violationEvent(m.Name(), typ, sev, reason, rec, now)
+				e.ViolationKey = rec.Key
+				evts = append(evts, e)
 			}
 		}
 	}
+	// anything still open but not matched this cycle has ended
+	open, err := store.OpenViolations()
+	if err != nil {
+		log.Error("violation tracking failed", "err", err)
+		return evts, nil
+	}
+	for _, v := range open {
+		if seen[v.Key] {
+			continue
+		}
+		reason := "process_exited"
+		if alive[processKey(v.PID, v.ProcessStarted)] {
+			reason = "no_longer_matching"
+		}
+		if err := store.CloseViolation(v.Key); err != nil {
+			log.Error("violation tracking failed", "err", err)
+			continue
+		}
+		// dry-run matches only report when they start
+		if strings.HasPrefix(v.Key, dryRunPrefix) {
+			continue
+		}
+		evts = append(evts, violationEvent(m.Name(), "policy_violation_ended", events.SeverityInfo, reason, v, now))
+	}
 	return evts, nil
 }
+
+// dryRunPrefix marks the violation keys of dry-run matches, which are tracked
+// apart from enforced ones.
+const dryRunPrefix = "dry_run|"
+
+// processKey identifies a process instance; the create time guards against PID reuse.
+func processKey(pid int32, started int64) string {
+	return fmt.Sprintf("%d@%d", pid, started)
+}
+
+func violationEvent(module, typ, sev, reason string, v events.Violation, now time.Time) events.Event {
+	payload, _ := json.Marshal(map[string]any{
+		"policy_id":      v.PolicyID,
+		"policy_version": v.PolicyVersion,
+		"rule_id":        v.RuleID,
+		"process":        map[string]any{"name": v.ProcessName, "pid": v.PID, "create_time": v.ProcessStarted},
+		"reason":         reason,
+		"first_seen":     v.FirstSeen.UTC().Format(time.RFC3339),
+		"last_seen":      v.LastSeen.UTC().Format(time.RFC3339),
+		"count":          v.Count,
+	})
+	return events.Event{Timestamp: now, Type: typ, Severity: sev, Module: module, Payload: string(payload)}
+}
+
+// ruleSeverity returns the rule's declared severity, defaulting to medium for
+// detections and high for rules that ask for a kill.
+func ruleSeverity(r policy.Rule) string {
+	if r.Severity != "" {
+		return r.Severity
+	}
+	if r.Action == policy.ActionKill {
+		return events.SeverityHigh
+	}
+	return events.SeverityMedium
+}
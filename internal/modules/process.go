@@ -38,6 +38,8 @@ func (m *processModule) Run(ctx context.Context, cfg *config.Config, store event
 	evt := events.Event{
 		Timestamp: time.Now().UTC(),
 		Type:      "process_list",
+		Severity:  events.SeverityInfo,
+		Module:    m.Name(),
 		Payload:   string(b),
 	}
 	return []events.Event{evt}, nil
@@ -36,6 +36,8 @@ func (m *sysinfoModule) Run(ctx context.Context, cfg *config.Config, store event
 	evt := events.Event{
 		Timestamp: time.Now().UTC(),
 		Type:      "sysinfo",
+		Severity:  events.SeverityInfo,
+		Module:    m.Name(),
 		Payload:   string(b),
 	}
 	return []events.Event{evt}, nil
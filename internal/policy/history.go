@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Revision is one stored version of a policy.
+type Revision struct {
+	PolicyID   string `json:"policy_id"`
+	Revision   int64  `json:"revision"`
+	Name       string `json:"name"`
+	Raw        string `json:"raw"`
+	Priority   int    `json:"priority"`
+	Hash       string `json:"hash"`
+	Source     string `json:"source"`
+	Verified   bool   `json:"verified"`
+	KeyID      string `json:"key_id,omitempty"`
+	Created    string `json:"created"`
+	RolledBack bool   `json:"rolled_back"`
+	Current    bool   `json:"current"`
+	State      string `json:"state,omitempty"` // lifecycle state, for the current revision
+}
+
+// Hash returns the content hash recorded for a policy's raw form.
+func Hash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// History returns the stored revisions of a policy, newest first.
+func (s *DBStore) History(id string) ([]Revision, error) {
+	rows, err := s.db.Query(`SELECT h.policy_id, h.revision, h.name, h.raw, h.priority, h.hash, h.source, h.verified, h.key_id, h.created, h.rolled_back,
+            COALESCE(p.revision = h.revision, 0), CASE WHEN p.revision = h.revision THEN p.state ELSE '' END
+        FROM policy_history h LEFT JOIN policies p ON p.id = h.policy_id
+        WHERE h.policy_id = ? ORDER BY h.revision DESC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Revision{}
+	for rows.Next() {
+		var r Revision
+		if err := rows.Scan(&r.PolicyID, &r.Revision, &r.Name, &r.Raw, &r.Priority, &r.Hash, &r.Source, &r.Verified, &r.KeyID, &r.Created, &r.RolledBack, &r.Current, &r.State); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// Rollback re-activates an earlier revision of a policy, in the active state. A revision of 0 means
+// the one before the active revision. It returns the revision that was active
+// and the policy as now stored. The replaced revision is marked rolled back so
+// fetches can refuse to re-apply it.
+func (s *DBStore) Rollback(id string, revision int64) (from int64, p *Policy, err error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+	if err := tx.QueryRow(`SELECT revision FROM policies WHERE id = ?`, id).Scan(&from); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, fmt.Errorf("policy %q not found", id)
+		}
+		return 0, nil, err
+	}
+	if revision == 0 {
+		var prev sql.NullInt64
+		if err = tx.QueryRow(`SELECT MAX(revision) FROM policy_history WHERE policy_id = ? AND revision < ?`, id, from).Scan(&prev); err != nil {
+			return 0, nil, err
+		}
+		if !prev.Valid {
+			return 0, nil, fmt.Errorf("policy %q has no revision before %d", id, from)
+		}
+		revision = prev.Int64
+	}
+	if revision == from {
+		return 0, nil, fmt.Errorf("revision %d of policy %q is already active", revision, id)
+	}
+	p = &Policy{ID: id, Revision: revision, Updated: time.Now().UTC()}
+	err = tx.QueryRow(`SELECT name, raw, priority, hash, source, verified, key_id FROM policy_history
+        WHERE policy_id = ? AND revision = ?`, id, revision).Scan(&p.Name, &p.Raw, &p.Priority, &p.Hash, &p.Source, &p.Verified, &p.KeyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil, fmt.Errorf("policy %q has no revision %d", id, revision)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	p.State, p.StateChanged = StateActive, p.Updated
+	if _, err := tx.Exec(`UPDATE policies SET name = ?, raw = ?, priority = ?, revision = ?, hash = ?, source = ?, verified = ?, key_id = ?,
+            state = ?, live_revision = 0, state_changed = ?, updated = ?, auto_promote = 0 WHERE id = ?`, p.Name, p.Raw, p.Priority, p.Revision, p.Hash, p.Source,
+		p.Verified, p.KeyID, p.State, p.Updated.Format(time.RFC3339), p.Updated.Format(time.RFC3339), id); err != nil {
+		return 0, nil, err
+	}
+	if _, err := tx.Exec(`UPDATE policy_history SET rolled_back = (revision = ?) WHERE policy_id = ? AND revision IN (?, ?)`,
+		from, id, from, revision); err != nil {
+		return 0, nil, err
+	}
+	return from, p, tx.Commit()
+}
+
+// RolledBack reports whether the latest revision of policy id with the given
+// content hash was rolled back away from.
+func (s *DBStore) RolledBack(id, hash string) bool {
+	var rolled bool
+	_ = s.db.QueryRow(`SELECT rolled_back FROM policy_history WHERE policy_id = ? AND hash = ?
+        ORDER BY revision DESC LIMIT 1`, id, hash).Scan(&rolled)
+	return rolled
+}
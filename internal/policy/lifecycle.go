@@ -0,0 +1,132 @@
+package policy
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Lifecycle states of a policy. Staged policies are stored but not evaluated,
+// dry-run policies are evaluated without taking action, active ones are
+// enforced and retired ones are kept only for their history.
+const (
+	StateStaged  = "staged"
+	StateDryRun  = "dry_run"
+	StateActive  = "active"
+	StateRetired = "retired"
+)
+
+// States lists the lifecycle states in promotion order.
+var States = []string{StateRetired, StateStaged, StateDryRun, StateActive}
+
+// Transition records a policy moving between lifecycle states.
+type Transition struct {
+	PolicyID string `json:"policy_id"`
+	Revision int64  `json:"revision"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+}
+
+// Step returns the state one step above (up) or below state in promotion
+// order, or "" when there is none.
+func Step(state string, up bool) string {
+	for i, st := range States {
+		if st != state {
+			continue
+		}
+		if up && i+1 < len(States) {
+			return States[i+1]
+		}
+		if !up && i > 0 {
+			return States[i-1]
+		}
+	}
+	return ""
+}
+
+// SetState moves policy id to state. Promoting to active, or retiring, stops
+// enforcement of any earlier revision it was standing in for.
+func (s *DBStore) SetState(id, state string, now time.Time) (Transition, error) {
+	t := Transition{PolicyID: id, To: state}
+	if !validState(state) {
+		return t, fmt.Errorf("unknown policy state %q", state)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return t, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`SELECT revision, state FROM policies WHERE id = ?`, id).Scan(&t.Revision, &t.From)
+	if errors.Is(err, sql.ErrNoRows) {
+		return t, fmt.Errorf("policy %q not found", id)
+	}
+	if err != nil {
+		return t, err
+	}
+	if t.From == state {
+		return t, fmt.Errorf("policy %q is already %s", id, state)
+	}
+	// a staged or dry-run revision keeps the previous one enforced; any other
+	// move hands enforcement to this revision alone
+	live := `0`
+	if state == StateStaged || state == StateDryRun {
+		live = `live_revision`
+	}
+	// an operator's move is final: the revision is no longer promoted on its own
+	if _, err := tx.Exec(`UPDATE policies SET state = ?, live_revision = `+live+`, state_changed = ?, auto_promote = 0 WHERE id = ?`,
+		state, now.UTC().Format(time.RFC3339), id); err != nil {
+		return t, err
+	}
+	return t, tx.Commit()
+}
+
+// PromoteDue activates policies that were stored staged and have waited at
+// least grace. A policy an operator moved to staged is left alone.
+func (s *DBStore) PromoteDue(grace time.Duration, now time.Time) ([]Transition, error) {
+	rows, err := s.db.Query(`SELECT id FROM policies WHERE state = ? AND auto_promote = 1 AND state_changed <= ?`,
+		StateStaged, now.Add(-grace).UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := []Transition{}
+	for _, id := range ids {
+		t, err := s.SetState(id, StateActive, now)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// InitialState reports whether a new revision may be stored in state.
+func InitialState(state string) bool {
+	switch state {
+	case StateStaged, StateDryRun, StateActive:
+		return true
+	}
+	return false
+}
+
+func validState(state string) bool {
+	for _, st := range States {
+		if st == state {
+			return true
+		}
+	}
+	return false
+}
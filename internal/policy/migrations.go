@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"database/sql"
+
+	"sentinel-agent/internal/migrate"
+)
+
+// migrations is the ordered schema history of the policies table. Append only.
+var migrations = []migrate.Migration{
+	{Version: 1, Name: "create_policies", Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS policies (
+            id TEXT PRIMARY KEY,
+            name TEXT,
+            raw TEXT NOT NULL,
+            updated TEXT NOT NULL
+        );`)
+		return err
+	}},
+	{Version: 2, Name: "revision_priority", Up: func(tx *sql.Tx) error {
+		if _, err := migrate.AddColumn(tx, "policies", "revision", `INTEGER NOT NULL DEFAULT 1`); err != nil {
+			return err
+		}
+		_, err := migrate.AddColumn(tx, "policies", "priority", `INTEGER NOT NULL DEFAULT 0`)
+		return err
+	}},
+	{Version: 3, Name: "policy_history", Up: func(tx *sql.Tx) error {
+		if _, err := migrate.AddColumn(tx, "policies", "hash", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := migrate.AddColumn(tx, "policies", "source", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS policy_history (
+            policy_id TEXT NOT NULL,
+            revision INTEGER NOT NULL,
+            name TEXT NOT NULL DEFAULT '',
+            raw TEXT NOT NULL,
+            priority INTEGER NOT NULL DEFAULT 0,
+            hash TEXT NOT NULL,
+            source TEXT NOT NULL DEFAULT '',
+            created TEXT NOT NULL,
+            rolled_back INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY (policy_id, revision)
+        );`); err != nil {
+			return err
+		}
+		// the stored policies become the first entry of their history
+		rows, err := tx.Query(`SELECT id, COALESCE(name, ''), raw, priority, revision, updated FROM policies`)
+		if err != nil {
+			return err
+		}
+		var revs []Revision
+		for rows.Next() {
+			var r Revision
+			if err := rows.Scan(&r.PolicyID, &r.Name, &r.Raw, &r.Priority, &r.Revision, &r.Created); err != nil {
+				rows.Close()
+				return err
+			}
+			revs = append(revs, r)
+		}
+		rows.Close()
+		for _, r := range revs {
+			h := Hash(r.Raw)
+			if _, err := tx.Exec(`UPDATE policies SET hash = ? WHERE id = ?`, h, r.PolicyID); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT INTO policy_history(policy_id, revision, name, raw, priority, hash, created)
+                VALUES (?, ?, ?, ?, ?, ?, ?)`, r.PolicyID, r.Revision, r.Name, r.Raw, r.Priority, h, r.Created); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{Version: 4, Name: "signature_verification", Up: func(tx *sql.Tx) error {
+		for _, table := range []string{"policies", "policy_history"} {
+			if _, err := migrate.AddColumn(tx, table, "verified", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+				return err
+			}
+			if _, err := migrate.AddColumn(tx, table, "key_id", `TEXT NOT NULL DEFAULT ''`); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{Version: 5, Name: "lifecycle_state", Up: func(tx *sql.Tx) error {
+		if _, err := migrate.AddColumn(tx, "policies", "state", `TEXT NOT NULL DEFAULT 'active'`); err != nil {
+			return err
+		}
+		if _, err := migrate.AddColumn(tx, "policies", "live_revision", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		if _, err := migrate.AddColumn(tx, "policies", "state_changed", `TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE policies SET state_changed = updated`)
+		return err
+	}},
+	{Version: 6, Name: "auto_promote", Up: func(tx *sql.Tx) error {
+		if _, err := migrate.AddColumn(tx, "policies", "auto_promote", `INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+		// only revisions still in the state they were stored in; anything an
+		// operator moved since waits for the operator
+		_, err := tx.Exec(`UPDATE policies SET auto_promote = 1 WHERE state = 'staged' AND state_changed =
+            (SELECT created FROM policy_history h WHERE h.policy_id = policies.id AND h.revision = policies.revision)`)
+		return err
+	}},
+	{Version: 7, Name: "signature_serials", Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS policy_serials (
+            source TEXT PRIMARY KEY,
+            serial INTEGER NOT NULL,
+            hash TEXT NOT NULL,
+            updated TEXT NOT NULL
+        );`)
+		return err
+	}},
+}
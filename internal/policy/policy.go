@@ -3,10 +3,24 @@ package policy
 import "time"
 
 type Policy struct {
-	ID      string
-	Name    string
-	Raw     string
-	Updated time.Time
+	ID   string
+	Name string
+	Raw  string
+	// Priority orders enforcement, highest first; Revision counts changes to Raw.
+	Priority int
+	Revision int64
+	// Hash is the SHA-256 of Raw and Source where it was loaded from.
+	Hash   string
+	Source string
+	// Verified is set when Raw came with a valid signature by trusted key KeyID.
+	Verified bool
+	KeyID    string
+	// State is the lifecycle state of this revision. While it is staged or in
+	// dry run, LiveRevision (when non-zero) is the revision still enforced.
+	State        string
+	LiveRevision int64
+	StateChanged time.Time
+	Updated      time.Time
 }
 
 type Store struct {
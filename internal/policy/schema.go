@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"encoding/json"
+	"time"
+
+	"sentinel-agent/internal/events"
+)
+
+// DocumentVersion is the policy file format version this agent understands.
+const DocumentVersion = 1
+
+// Rule types and actions the enforcer implements.
+const (
+	RuleBlockProcess = "block_process"
+
+	ActionAlert = "alert"
+	ActionKill  = "kill"
+)
+
+// Document is a policy file as loaded from disk or fetched from policy_url.
+type Document struct {
+	Version  int          `yaml:"version" json:"version"`
+	Policies []Definition `yaml:"policies" json:"policies"`
+}
+
+// Definition is one policy. It is stored as JSON in Policy.Raw, carrying the
+// version of the document it came from. Policies with a higher Priority are
+// enforced first: a process is reported by the first rule that matches it.
+// State is the lifecycle state a new revision starts in; it is not content.
+type Definition struct {
+	Version  int    `yaml:"version,omitempty" json:"version"`
+	ID       string `yaml:"id" json:"id"`
+	Name     string `yaml:"name" json:"name"`
+	Priority int    `yaml:"priority,omitempty" json:"priority,omitempty"`
+	State    string `yaml:"state,omitempty" json:"-"`
+	Rules    []Rule `yaml:"rules" json:"rules"`
+}
+
+type Rule struct {
+	ID       string `yaml:"id" json:"id"`
+	Type     string `yaml:"type" json:"type"`
+	Match    string `yaml:"match" json:"match"`
+	Action   string `yaml:"action,omitempty" json:"action,omitempty"`
+	Severity string `yaml:"severity,omitempty" json:"severity,omitempty"`
+}
+
+// Parse decodes and validates a policy document (YAML or JSON). Every problem
+// found is reported in a *ValidationError with its line and column.
+func Parse(src []byte) (*Document, error) {
+	root, err := parseNode(src)
+	if err != nil {
+		return nil, err
+	}
+	v := &validator{}
+	v.document(root)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := root.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// LoadDefinition decodes a stored policy for enforcement. Rows written before
+// policies were validated may lack a version or carry fields the schema does
+// not know; instead of dropping such a policy it returns its problems along
+// with the rules that can still be enforced, as the agent did before.
+// Only a policy that cannot be decoded at all is an error.
+func LoadDefinition(raw string) (*Definition, []Problem, error) {
+	root, err := parseNode([]byte(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	v := &validator{}
+	v.definition(root, "policy", false)
+	if v.err() == nil {
+		var d Definition
+		if err := root.Decode(&d); err != nil {
+			return nil, nil, err
+		}
+		return &d, nil, nil
+	}
+	var loose struct {
+		Rules []map[string]any `yaml:"rules"`
+	}
+	if err := root.Decode(&loose); err != nil {
+		return nil, v.problems, err
+	}
+	d := &Definition{}
+	for _, m := range loose.Rules {
+		str := func(k string) string { s, _ := m[k].(string); return s }
+		r := Rule{ID: str("id"), Type: str("type"), Match: str("match"), Action: str("action"), Severity: str("severity")}
+		if r.Type != RuleBlockProcess || r.Match == "" {
+			continue
+		}
+		if !actions[r.Action] {
+			r.Action = ""
+		}
+		switch r.Severity {
+		case events.SeverityInfo, events.SeverityLow, events.SeverityMedium, events.SeverityHigh, events.SeverityCritical:
+		default:
+			r.Severity = ""
+		}
+		d.Rules = append(d.Rules, r)
+	}
+	return d, v.problems, nil
+}
+
+// Stored returns the policies of doc ready to be written to the store,
+// recording source (e.g. "file:/path" or "url:https://...") as their origin.
+func (doc *Document) Stored(source string, now time.Time) []*Policy {
+	out := make([]*Policy, 0, len(doc.Policies))
+	for _, d := range doc.Policies {
+		d.Version = doc.Version
+		b, _ := json.Marshal(d)
+		out = append(out, &Policy{ID: d.ID, Name: d.Name, Raw: string(b), Priority: d.Priority, State: d.State, Source: source, Updated: now.UTC()})
+	}
+	return out
+}
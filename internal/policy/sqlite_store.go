@@ -2,59 +2,83 @@ package policy
 
 import (
 	"database/sql"
-	"os"
-	"path/filepath"
+	"errors"
+	"fmt"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"sentinel-agent/internal/migrate"
 )
 
+const policyColumns = `id, name, raw, priority, revision, hash, source, verified, key_id, state, live_revision, state_changed, updated`
+
 type DBStore struct {
 	db *sql.DB
 }
 
-// NewDBStore opens (or creates) a policies table in the same DB path used by events.
-func NewDBStore(dbPath string) (*DBStore, error) {
-	// ensure directory exists
-	dir := filepath.Dir(dbPath)
-	_ = os.MkdirAll(dir, 0o755)
-	db, err := sql.Open("sqlite", dbPath+"?_foreign_keys=1")
-	if err != nil {
-		return nil, err
-	}
-	if err := createPolicyTable(db); err != nil {
-		db.Close()
+// NewDBStore migrates the policies table on db, which is owned by the caller
+// (normally storage.DB) and shared with the event store.
+func NewDBStore(db *sql.DB) (*DBStore, error) {
+	if err := migrate.Run(db, "policies", migrations); err != nil {
 		return nil, err
 	}
 	return &DBStore{db: db}, nil
 }
 
-func createPolicyTable(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS policies (
-        id TEXT PRIMARY KEY,
-        name TEXT,
-        raw TEXT NOT NULL,
-        updated TEXT NOT NULL
-    );`)
-	return err
-}
-
 // Get returns the most recently updated policy (or nil)
 func (s *DBStore) Get() *Policy {
-	row := s.db.QueryRow(`SELECT id, name, raw, updated FROM policies ORDER BY updated DESC LIMIT 1`)
-	var id, name, raw, updated string
-	if err := row.Scan(&id, &name, &raw, &updated); err != nil {
+	p, err := scanPolicy(s.db.QueryRow(`SELECT ` + policyColumns + ` FROM policies ORDER BY updated DESC LIMIT 1`))
+	if err != nil {
 		return nil
 	}
-	t, _ := time.Parse(time.RFC3339, updated)
-	return &Policy{ID: id, Name: name, Raw: raw, Updated: t}
+	return p
+}
+
+// Find returns the stored policy with the given id.
+func (s *DBStore) Find(id string) (*Policy, error) {
+	p, err := scanPolicy(s.db.QueryRow(`SELECT `+policyColumns+` FROM policies WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("policy %q not found", id)
+	}
+	return p, err
 }
 
-// Set inserts or replaces a policy by id (if id empty, use 'active')
+// Active returns every policy the enforcer evaluates in precedence order:
+// highest priority first, then by id. These are active and dry-run policies,
+// plus the last active revision of a policy whose newer revision is staged or
+// in dry run, which keeps being enforced until that revision is promoted.
+func (s *DBStore) Active() ([]*Policy, error) {
+	rows, err := s.db.Query(`SELECT `+policyColumns+` FROM policies WHERE state IN (?, ?)
+        UNION ALL
+        SELECT h.policy_id, h.name, h.raw, h.priority, h.revision, h.hash, h.source, h.verified, h.key_id, ?, 0, p.state_changed, p.updated
+        FROM policies p JOIN policy_history h ON h.policy_id = p.id AND h.revision = p.live_revision
+        WHERE p.state IN (?, ?)
+        ORDER BY priority DESC, id, state`, StateActive, StateDryRun, StateActive, StateStaged, StateDryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*Policy{}
+	for rows.Next() {
+		p, err := scanPolicy(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// Set inserts or replaces a policy by id (if id empty, use 'active'). A change
+// of content becomes a new revision, kept in the policy's history, that starts
+// in p.State (default active); a revision that is not active leaves the
+// previously active one enforced. Unchanged content keeps its current state.
 func (s *DBStore) Set(p *Policy) error {
 	if p == nil {
 		return nil
 	}
+	if p.State != "" && !InitialState(p.State) {
+		return fmt.Errorf("unknown initial policy state %q (want staged, dry_run or active)", p.State)
+	}
 	id := p.ID
 	if id == "" {
 		id = "active"
@@ -62,9 +86,101 @@ func (s *DBStore) Set(p *Policy) error {
 	if p.Updated.IsZero() {
 		p.Updated = time.Now().UTC()
 	}
-	_, err := s.db.Exec(`INSERT INTO policies(id, name, raw, updated) VALUES (?, ?, ?, ?)
-        ON CONFLICT(id) DO UPDATE SET name=excluded.name, raw=excluded.raw, updated=excluded.updated`, id, p.Name, p.Raw, p.Updated.Format(time.RFC3339))
+	p.Hash = Hash(p.Raw)
+	updated := p.Updated.Format(time.RFC3339)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var cur, curState, curChanged string
+	var curLive int64
+	err = tx.QueryRow(`SELECT hash, revision, state, live_revision, state_changed FROM policies WHERE id = ?`, id).
+		Scan(&cur, &p.Revision, &curState, &curLive, &curChanged)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	exists := err == nil
+	if exists && cur == p.Hash {
+		_, err = tx.Exec(`UPDATE policies SET name = ?, priority = ?, source = ?, verified = ?, key_id = ?, updated = ? WHERE id = ?`,
+			p.Name, p.Priority, p.Source, p.Verified, p.KeyID, updated, id)
+		if err != nil {
+			return err
+		}
+		p.State, p.LiveRevision = curState, curLive
+		p.StateChanged, _ = time.Parse(time.RFC3339, curChanged)
+		return tx.Commit()
+	}
+	if p.State == "" {
+		p.State = StateActive
+	}
+	p.LiveRevision, p.StateChanged = 0, p.Updated
+	if exists && p.State != StateActive {
+		switch curState {
+		case StateActive:
+			p.LiveRevision = p.Revision
+		case StateStaged, StateDryRun:
+			p.LiveRevision = curLive
+		}
+	}
+	// revisions are never reused, even after a rollback
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(revision), 0) + 1 FROM policy_history WHERE policy_id = ?`, id).Scan(&p.Revision); err != nil {
+		return err
+	}
+	// only a revision that arrives staged is promoted after the grace period
+	if _, err := tx.Exec(`INSERT INTO policies(id, name, raw, priority, revision, hash, source, verified, key_id, state, live_revision, state_changed, updated, auto_promote)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET name=excluded.name, raw=excluded.raw, priority=excluded.priority, revision=excluded.revision,
+            hash=excluded.hash, source=excluded.source, verified=excluded.verified, key_id=excluded.key_id, state=excluded.state,
+            live_revision=excluded.live_revision, state_changed=excluded.state_changed, updated=excluded.updated, auto_promote=excluded.auto_promote`,
+		id, p.Name, p.Raw, p.Priority, p.Revision, p.Hash, p.Source, p.Verified, p.KeyID, p.State, p.LiveRevision, updated, updated, p.State == StateStaged); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO policy_history(policy_id, revision, name, raw, priority, hash, source, verified, key_id, created)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, p.Revision, p.Name, p.Raw, p.Priority, p.Hash, p.Source, p.Verified, p.KeyID, updated); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CheckSerial refuses a document with content hash signed under serial when
+// source already delivered a newer one, or different content under the same
+// serial: a replayed older document must not downgrade enforcement.
+func (s *DBStore) CheckSerial(source string, serial int64, hash string) error {
+	var last int64
+	var lastHash string
+	err := s.db.QueryRow(`SELECT serial, hash FROM policy_serials WHERE source = ?`, source).Scan(&last, &lastHash)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	case serial < last:
+		return fmt.Errorf("signature serial %d is older than the stored serial %d", serial, last)
+	case serial == last && hash != lastHash:
+		return fmt.Errorf("signature serial %d was already used for another document", serial)
+	}
+	return nil
+}
+
+// SetSerial records that the document with content hash, signed under serial,
+// was stored from source.
+func (s *DBStore) SetSerial(source string, serial int64, hash string, now time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO policy_serials(source, serial, hash, updated) VALUES (?, ?, ?, ?)
+        ON CONFLICT(source) DO UPDATE SET serial=excluded.serial, hash=excluded.hash, updated=excluded.updated
+        WHERE excluded.serial >= policy_serials.serial`, source, serial, hash, now.UTC().Format(time.RFC3339))
 	return err
 }
 
-func (s *DBStore) Close() error { return s.db.Close() }
+func scanPolicy(row interface{ Scan(...any) error }) (*Policy, error) {
+	var p Policy
+	var changed, updated string
+	if err := row.Scan(&p.ID, &p.Name, &p.Raw, &p.Priority, &p.Revision, &p.Hash, &p.Source, &p.Verified, &p.KeyID,
+		&p.State, &p.LiveRevision, &changed, &updated); err != nil {
+		return nil, err
+	}
+	p.StateChanged, _ = time.Parse(time.RFC3339, changed)
+	p.Updated, _ = time.Parse(time.RFC3339, updated)
+	return &p, nil
+}
@@ -0,0 +1,229 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"sentinel-agent/internal/events"
+)
+
+// Problem is one reason a policy was rejected, located in its source.
+type Problem struct {
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Path   string `json:"path"`
+	Msg    string `json:"message"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("line %d, column %d: %s: %s", p.Line, p.Column, p.Path, p.Msg)
+}
+
+// ValidationError lists every problem found in a policy, in source order.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return fmt.Sprintf("invalid policy (%d problems):\n  %s", len(e.Problems), strings.Join(lines, "\n  "))
+}
+
+var (
+	documentFields   = map[string]bool{"version": true, "policies": true}
+	definitionFields = map[string]bool{"version": true, "id": true, "name": true, "priority": true, "state": true, "rules": true}
+	ruleFields       = map[string]bool{"id": true, "type": true, "match": true, "action": true, "severity": true}
+
+	ruleTypes = map[string]bool{RuleBlockProcess: true}
+	actions   = map[string]bool{ActionAlert: true, ActionKill: true}
+)
+
+func parseNode(src []byte) (*yaml.Node, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(src, &root); err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		return nil, errors.New("empty policy document")
+	}
+	return root.Content[0], nil
+}
+
+// validator walks a YAML node tree and collects problems instead of stopping
+// at the first, so an operator sees everything wrong with a file at once.
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(n *yaml.Node, path, format string, args ...any) {
+	v.problems = append(v.problems, Problem{Line: n.Line, Column: n.Column, Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return &ValidationError{Problems: v.problems}
+}
+
+func (v *validator) document(n *yaml.Node) {
+	fields := v.mapping(n, "document", documentFields)
+	if fields == nil {
+		return
+	}
+	v.version(fields, n, "document", true)
+	pols := fields["policies"]
+	if pols == nil {
+		v.add(n, "document", "missing required field %q", "policies")
+		return
+	}
+	if pols.Kind != yaml.SequenceNode {
+		v.add(pols, "policies", "expected a list of policies")
+		return
+	}
+	ids := map[string]bool{}
+	for i, p := range pols.Content {
+		path := "policies[" + strconv.Itoa(i) + "]"
+		if id := v.definition(p, path, true); id != "" {
+			if ids[id] {
+				v.add(p, path, "duplicate policy id %q", id)
+			}
+			ids[id] = true
+		}
+	}
+}
+
+// definition validates one policy and returns its id.
+func (v *validator) definition(n *yaml.Node, path string, requireID bool) string {
+	fields := v.mapping(n, path, definitionFields)
+	if fields == nil {
+		return ""
+	}
+	v.version(fields, n, path, false)
+	id := v.str(fields, n, path, "id", requireID)
+	v.str(fields, n, path, "name", false)
+	if p := fields["priority"]; p != nil && (p.Kind != yaml.ScalarNode || p.Tag != "!!int") {
+		v.add(p, path+".priority", "expected an integer")
+	}
+	if st := v.str(fields, n, path, "state", false); st != "" && !InitialState(st) {
+		v.add(fields["state"], path+".state", "unknown initial state %q (want staged, dry_run or active)", st)
+	}
+	rules := fields["rules"]
+	if rules == nil {
+		v.add(n, path, "missing required field %q", "rules")
+		return id
+	}
+	if rules.Kind != yaml.SequenceNode {
+		v.add(rules, path+".rules", "expected a list of rules")
+		return id
+	}
+	ids := map[string]bool{}
+	for i, r := range rules.Content {
+		rpath := path + ".rules[" + strconv.Itoa(i) + "]"
+		if rid := v.rule(r, rpath); rid != "" {
+			if ids[rid] {
+				v.add(r, rpath, "duplicate rule id %q", rid)
+			}
+			ids[rid] = true
+		}
+	}
+	return id
+}
+
+func (v *validator) rule(n *yaml.Node, path string) string {
+	fields := v.mapping(n, path, ruleFields)
+	if fields == nil {
+		return ""
+	}
+	id := v.str(fields, n, path, "id", true)
+	if typ := v.str(fields, n, path, "type", true); typ != "" && !ruleTypes[typ] {
+		v.add(fields["type"], path+".type", "unknown rule type %q", typ)
+	}
+	v.str(fields, n, path, "match", true)
+	if action := v.str(fields, n, path, "action", false); action != "" && !actions[action] {
+		v.add(fields["action"], path+".action", "unknown action %q (want alert or kill)", action)
+	}
+	switch sev := v.str(fields, n, path, "severity", false); sev {
+	case "", events.SeverityInfo, events.SeverityLow, events.SeverityMedium, events.SeverityHigh, events.SeverityCritical:
+	default:
+		v.add(fields["severity"], path+".severity", "unknown severity %q", sev)
+	}
+	return id
+}
+
+// mapping checks that n is a mapping of known fields and returns them by name.
+func (v *validator) mapping(n *yaml.Node, path string, known map[string]bool) map[string]*yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		v.add(n, path, "expected a mapping")
+		return nil
+	}
+	out := map[string]*yaml.Node{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, val := n.Content[i], n.Content[i+1]
+		switch {
+		case !known[k.Value]:
+			v.add(k, path, "unknown field %q", k.Value)
+		case out[k.Value] != nil:
+			v.add(k, path, "duplicate field %q", k.Value)
+		default:
+			out[k.Value] = val
+		}
+	}
+	return out
+}
+
+// str returns the scalar value of field key, reporting it when missing or not a scalar.
+func (v *validator) str(fields map[string]*yaml.Node, parent *yaml.Node, path, key string, required bool) string {
+	n := fields[key]
+	if n == nil || n.Tag == "!!null" {
+		if required {
+			v.add(parentOr(n, parent), path, "missing required field %q", key)
+		}
+		return ""
+	}
+	if n.Kind != yaml.ScalarNode {
+		v.add(n, path+"."+key, "expected a string")
+		return ""
+	}
+	if required && strings.TrimSpace(n.Value) == "" {
+		v.add(n, path+"."+key, "must not be empty")
+	}
+	return n.Value
+}
+
+func (v *validator) version(fields map[string]*yaml.Node, parent *yaml.Node, path string, required bool) {
+	n := fields["version"]
+	if n == nil {
+		if required {
+			v.add(parent, path, "missing required field %q", "version")
+		}
+		return
+	}
+	if n.Kind != yaml.ScalarNode || n.Tag != "!!int" {
+		v.add(n, path+".version", "expected an integer")
+		return
+	}
+	if ver, _ := strconv.Atoi(n.Value); ver != DocumentVersion {
+		v.add(n, path+".version", "unsupported version %d (want %d)", ver, DocumentVersion)
+	}
+}
+
+// parentOr points at n when present (an explicit null) and at parent otherwise.
+func parentOr(n, parent *yaml.Node) *yaml.Node {
+	if n != nil {
+		return n
+	}
+	return parent
+}
@@ -0,0 +1,170 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Problem
+	}{
+		{
+			name: "valid",
+			src: `version: 1
+policies:
+  - id: p1
+    rules:
+      - {id: r1, type: block_process, match: nc, action: kill, severity: high}
+`,
+		},
+		{
+			name: "missing version",
+			src: `policies:
+  - id: p1
+    rules: []
+`,
+			want: []Problem{{Line: 1, Column: 1, Path: "document", Msg: `missing required field "version"`}},
+		},
+		{
+			name: "unsupported version",
+			src: `version: 2
+policies: []
+`,
+			want: []Problem{{Line: 1, Column: 10, Path: "document.version", Msg: "unsupported version 2 (want 1)"}},
+		},
+		{
+			name: "unknown fields",
+			src: `version: 1
+owner: ops
+policies:
+  - id: p1
+    rules:
+      - id: r1
+        type: block_process
+        match: nc
+        note: old
+`,
+			want: []Problem{
+				{Line: 2, Column: 1, Path: "document", Msg: `unknown field "owner"`},
+				{Line: 9, Column: 9, Path: "policies[0].rules[0]", Msg: `unknown field "note"`},
+			},
+		},
+		{
+			name: "duplicate ids",
+			src: `version: 1
+policies:
+  - id: p1
+    rules:
+      - {id: r1, type: block_process, match: a}
+      - {id: r1, type: block_process, match: b}
+  - id: p1
+    rules: []
+`,
+			want: []Problem{
+				{Line: 6, Column: 9, Path: "policies[0].rules[1]", Msg: `duplicate rule id "r1"`},
+				{Line: 7, Column: 5, Path: "policies[1]", Msg: `duplicate policy id "p1"`},
+			},
+		},
+		{
+			name: "bad values",
+			src: `version: 1
+policies:
+  - id: p1
+    priority: high
+    state: retired
+    rules:
+      - {id: r1, type: watch, match: nc, action: ban, severity: urgent}
+`,
+			want: []Problem{
+				{Line: 4, Column: 15, Path: "policies[0].priority", Msg: "expected an integer"},
+				{Line: 5, Column: 12, Path: "policies[0].state", Msg: `unknown initial state "retired" (want staged, dry_run or active)`},
+				{Line: 7, Column: 24, Path: "policies[0].rules[0].type", Msg: `unknown rule type "watch"`},
+				{Line: 7, Column: 50, Path: "policies[0].rules[0].action", Msg: `unknown action "ban" (want alert or kill)`},
+				{Line: 7, Column: 65, Path: "policies[0].rules[0].severity", Msg: `unknown severity "urgent"`},
+			},
+		},
+		{
+			name: "missing fields",
+			src: `version: 1
+policies:
+  - name: unnamed
+`,
+			want: []Problem{
+				{Line: 3, Column: 5, Path: "policies[0]", Msg: `missing required field "id"`},
+				{Line: 3, Column: 5, Path: "policies[0]", Msg: `missing required field "rules"`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.src))
+			var got []Problem
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				got = verr.Problems
+			} else if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadDefinition(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		rules    []Rule
+		problems int
+		err      bool
+	}{
+		{
+			name:  "current",
+			raw:   `{"version":1,"id":"p1","rules":[{"id":"r1","type":"block_process","match":"nc","severity":"high"}]}`,
+			rules: []Rule{{ID: "r1", Type: RuleBlockProcess, Match: "nc", Severity: "high"}},
+		},
+		{
+			name:     "legacy without version and with extra fields",
+			raw:      `{"rules":[{"id":"r1","type":"block_process","match":"nc","note":"old"},{"type":"other","match":"x"}]}`,
+			rules:    []Rule{{ID: "r1", Type: RuleBlockProcess, Match: "nc"}},
+			problems: 3,
+		},
+		{
+			name:     "unknown action and severity dropped",
+			raw:      `{"version":0,"rules":[{"id":"r1","type":"block_process","match":"nc","action":"ban","severity":"bad"}]}`,
+			rules:    []Rule{{ID: "r1", Type: RuleBlockProcess, Match: "nc"}},
+			problems: 3,
+		},
+		{
+			name: "not a policy",
+			raw:  `rules: [unclosed`,
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, problems, err := LoadDefinition(tt.raw)
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadDefinition: %v", err)
+			}
+			if len(problems) != tt.problems {
+				t.Errorf("got %d problems, want %d: %v", len(problems), tt.problems, problems)
+			}
+			if !reflect.DeepEqual(d.Rules, tt.rules) {
+				t.Errorf("rules\n got %+v\nwant %+v", d.Rules, tt.rules)
+			}
+		})
+	}
+}
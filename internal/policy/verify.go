@@ -0,0 +1,72 @@
+package policy
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Signature is a detached policy signature as published next to a policy
+// document: an Ed25519 signature over Serial and the document's exact bytes.
+// Serial grows with every document signed, so an older document cannot be
+// replayed in place of a newer one (see DBStore.CheckSerial).
+type Signature struct {
+	KeyID     string `json:"key_id"`
+	Serial    int64  `json:"serial"`
+	Signature string `json:"signature"`
+}
+
+// signed is the message a policy signature covers.
+func signed(serial int64, doc []byte) []byte {
+	return append([]byte("sentinel-policy\n"+strconv.FormatInt(serial, 10)+"\n"), doc...)
+}
+
+// KeyRing holds the public keys trusted to sign policies, by key ID.
+type KeyRing map[string]ed25519.PublicKey
+
+// Add trusts a base64-encoded Ed25519 public key under id.
+func (k KeyRing) Add(id, publicKey string) error {
+	if id == "" {
+		return errors.New("policy key without id")
+	}
+	b, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return fmt.Errorf("policy key %q: not a base64 Ed25519 public key", id)
+	}
+	k[id] = ed25519.PublicKey(b)
+	return nil
+}
+
+// Verify checks the detached signature sig over doc and returns it. Its key
+// ID is set whenever sig names one, even if verification fails.
+func (k KeyRing) Verify(doc, sig []byte) (Signature, error) {
+	var s Signature
+	if err := json.Unmarshal(sig, &s); err != nil {
+		return Signature{}, fmt.Errorf("malformed signature: %w", err)
+	}
+	key, ok := k[s.KeyID]
+	if !ok {
+		return s, fmt.Errorf("unknown signing key %q", s.KeyID)
+	}
+	if s.Serial <= 0 {
+		return s, errors.New("signature carries no serial")
+	}
+	raw, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return s, fmt.Errorf("malformed signature: %w", err)
+	}
+	if !ed25519.Verify(key, signed(s.Serial, doc), raw) {
+		return s, errors.New("signature does not verify")
+	}
+	return s, nil
+}
+
+// Sign returns a detached signature over serial and doc made with key.
+func Sign(key ed25519.PrivateKey, keyID string, serial int64, doc []byte) []byte {
+	b, _ := json.Marshal(Signature{KeyID: keyID, Serial: serial,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, signed(serial, doc)))})
+	return b
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+)
+
+// gatewayStateChanged returns a callback that records the named sink's
+// gateway going down or coming back as gateway_unreachable/gateway_recovered.
+func (s *Service) gatewayStateChanged(sink string) func(gateway.StateChange) {
+	return func(c gateway.StateChange) {
+		payload := map[string]any{"sink": sink, "url": c.URL}
+		e := events.Event{Timestamp: time.Now().UTC(), Module: "gateway"}
+		if c.Open {
+			e.Type, e.Severity = "gateway_unreachable", events.SeverityMedium
+			payload["consecutive_failures"] = c.Failures
+			payload["error"] = c.Err
+			payload["retry_at"] = c.Until.UTC().Format(time.RFC3339)
+			s.log.Error("gateway unreachable, pausing uploads", "sink", sink, "until", c.Until, "err", c.Err)
+		} else {
+			e.Type, e.Severity = "gateway_recovered", events.SeverityInfo
+			payload["down_seconds"] = int64(c.Down.Seconds())
+			s.log.Info("gateway recovered", "sink", sink, "down", c.Down.String())
+		}
+		b, _ := json.Marshal(payload)
+		e.Payload = string(b)
+		s.emit(e)
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+	"sentinel-agent/internal/logging"
+	"sentinel-agent/internal/sinks"
+)
+
+const (
+	outboxMinBackoff = 5 * time.Second
+	outboxIdle       = time.Minute
+)
+
+// dispatcher routes newly stored events to sinks and wakes their outboxes.
+type dispatcher struct {
+	store events.EventStore
+	route func(events.Event) []string
+	log   *logging.Logger
+	batch int
+	outs  []*outbox
+	wake  chan struct{}
+}
+
+func newDispatcher(store events.EventStore, route func(events.Event) []string, log *logging.Logger, batch int) *dispatcher {
+	return &dispatcher{store: store, route: route, log: log, batch: batch, wake: make(chan struct{}, 1)}
+}
+
+// Notify asks the dispatcher to route new events soon; it never blocks.
+func (d *dispatcher) Notify() { notify(d.wake) }
+
+// wakeSinks asks every outbox to drain, e.g. after deliveries were requeued.
+func (d *dispatcher) wakeSinks() {
+	for _, o := range d.outs {
+		o.Notify()
+	}
+}
+
+func (d *dispatcher) run(ctx context.Context) {
+	for {
+		d.dispatch()
+		timer := time.NewTimer(outboxIdle)
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func (d *dispatcher) dispatch() {
+	for {
+		n, err := d.store.Dispatch(d.route, d.batch)
+		if err != nil {
+			d.log.Error("event dispatch failed", "err", err)
+			return
+		}
+		if n == 0 {
+			return
+		}
+		d.wakeSinks()
+	}
+}
+
+// outbox drains undelivered events from the store to one sink in id order.
+// While the sink is failing it backs off exponentially and leaves the events
+// pending, so nothing is lost when the agent is offline, and other sinks keep
+// delivering.
+type outbox struct {
+	store       events.EventStore
+	name        string
+	sink        sinks.Sink
+	log         *logging.Logger
+	batch       int
+	maxAttempts int
+	maxBackoff  time.Duration
+	wake        chan struct{}
+	failures    int
+	retryAt     time.Time
+}
+
+func newOutbox(store events.EventStore, name string, sink sinks.Sink, log *logging.Logger, batch, maxAttempts int, maxBackoff time.Duration) *outbox {
+	return &outbox{
+		store:       store,
+		name:        name,
+		sink:        sink,
+		log:         log,
+		batch:       batch,
+		maxAttempts: maxAttempts,
+		maxBackoff:  maxBackoff,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify asks the outbox to drain soon; it never blocks.
+func (o *outbox) Notify() { notify(o.wake) }
+
+func notify(wake chan struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run(ctx context.Context) {
+	for {
+		wait := o.drain(ctx)
+		timer := time.NewTimer(wait)
+		select {
+		case <-o.wake:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// drain sends due events until none are left or a send fails, and returns how
+// long to wait before the next attempt.
+func (o *outbox) drain(ctx context.Context) time.Duration {
+	for {
+		now := time.Now().UTC()
+		if now.Before(o.retryAt) {
+			return o.retryAt.Sub(now)
+		}
+		if ctx.Err() != nil {
+			return outboxIdle
+		}
+		evts, err := o.store.Pending(o.name, o.batch, now)
+		if err != nil {
+			o.log.Error("outbox read failed", "sink", o.name, "err", err)
+			return outboxMinBackoff
+		}
+		if len(evts) == 0 {
+			return outboxIdle
+		}
+		results, err := o.sink.SendEvents(ctx, evts)
+		if results == nil && err == nil {
+			// nothing to deliver to (no gateway url configured)
+			results = []gateway.BatchResult{{IDs: eventIDs(evts), Accepted: eventIDs(evts)}}
+		} else if results == nil {
+			results = []gateway.BatchResult{{IDs: eventIDs(evts), Err: err}}
+		}
+		failed := 0
+		for _, r := range results {
+			var open *gateway.CircuitOpenError
+			if errors.As(r.Err, &open) {
+				// never attempted, so wait for the circuit without using up attempts
+				if failed == 0 || open.Until.After(o.retryAt) {
+					o.retryAt = open.Until
+				}
+				failed += len(r.IDs)
+				continue
+			}
+			if r.Err != nil {
+				o.log.Error("sink send failed", "sink", o.name, "err", r.Err, "events", len(r.IDs), "bytes", r.Bytes)
+			}
+			if err := o.store.MarkSent(o.name, r.Accepted); err != nil {
+				o.log.Error("outbox mark sent failed", "err", err)
+				return outboxMinBackoff
+			}
+			if len(r.Rejected) > 0 {
+				ids := make([]int64, len(r.Rejected))
+				for i, rj := range r.Rejected {
+					ids[i] = rj.ID
+					o.log.Error("sink rejected event", "sink", o.name, "id", rj.ID, "reason", rj.Reason, "sequence", r.Sequence)
+				}
+				if err := o.store.MarkFailed(o.name, ids); err != nil {
+					o.log.Error("outbox mark failed failed", "err", err)
+				}
+			}
+			retry := r.Unacknowledged()
+			if len(retry) == 0 {
+				continue
+			}
+			if failed == 0 {
+				o.failures++
+				o.retryAt = now.Add(backoff(o.failures, outboxMinBackoff, o.maxBackoff))
+			}
+			failed += len(retry)
+			if err := o.store.MarkRetry(o.name, retry, o.retryAt, o.maxAttempts); err != nil {
+				o.log.Error("outbox mark retry failed", "err", err)
+			}
+		}
+		if failed > 0 {
+			// acknowledged events stay delivered; the rest wait out the backoff
+			delay := o.retryAt.Sub(now)
+			o.log.Info("sink delivery backing off", "sink", o.name, "unacknowledged", failed, "retry_in", delay.String())
+			return delay
+		}
+		o.failures = 0
+	}
+}
+
+func eventIDs(evts []events.Event) []int64 {
+	ids := make([]int64, len(evts))
+	for i, e := range evts {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+// backoff returns base doubled for every failure after the first, capped at max.
+func backoff(failures int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/policy"
+)
+
+// promoteStaged activates staged policies whose grace period has passed.
+func (s *Service) promoteStaged() {
+	grace := time.Duration(s.cfg.PolicyStagingGraceSeconds) * time.Second
+	ts, err := s.pol.PromoteDue(grace, time.Now())
+	for _, t := range ts {
+		s.log.Info("staged policy promoted", "id", t.PolicyID, "revision", t.Revision)
+		s.emit(stateChangeEvent(t, "grace_period"))
+	}
+	if err != nil {
+		s.log.Error("staged policy promotion failed", "err", err)
+	}
+}
+
+// stateChangeEvent is the audit event for a policy lifecycle transition made by actor.
+func stateChangeEvent(t policy.Transition, actor string) events.Event {
+	payload, _ := json.Marshal(map[string]any{
+		"policy_id": t.PolicyID,
+		"revision":  t.Revision,
+		"from":      t.From,
+		"to":        t.To,
+		"actor":     actor,
+	})
+	return events.Event{Timestamp: time.Now().UTC(), Type: "policy_state_changed", Severity: events.SeverityMedium, Module: "policy", Payload: string(payload)}
+}
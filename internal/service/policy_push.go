@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// policyPushWait is how long the server may hold a watch request open
+	policyPushWait       = 60 * time.Second
+	policyPushMinBackoff = time.Second
+	policyPushMaxBackoff = 5 * time.Minute
+)
+
+// watchPolicy long-polls PolicyPushURL and fetches the policy as soon as the
+// server reports a new version. It reconnects with exponential backoff and,
+// while disconnected, leaves the regular poll loop in charge.
+func (s *Service) watchPolicy(ctx context.Context) {
+	// same transport, but the request may legitimately outlive the usual timeout
+	c := *s.http
+	c.Timeout = policyPushWait + 30*time.Second
+	version, failures := "", 0
+	for ctx.Err() == nil {
+		start := time.Now()
+		v, changed, err := s.waitPolicyVersion(ctx, &c, version)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if s.pushUp.Swap(false) {
+				s.log.Error("policy push channel lost, falling back to polling", "err", err)
+			}
+			failures++
+			sleepCtx(ctx, backoff(failures, policyPushMinBackoff, policyPushMaxBackoff))
+			continue
+		}
+		failures = 0
+		if !s.pushUp.Swap(true) {
+			s.log.Info("policy push channel connected")
+		}
+		if changed && (v == "" || v != version) {
+			s.log.Info("policy update notified", "version", v)
+			if err := s.fetchPolicy(); err != nil {
+				// keep the old version so the change is seen again, and let
+				// the poll loop retry in the meantime
+				s.log.Error("policy fetch failed", "err", err)
+				s.pushUp.Store(false)
+				failures++
+				sleepCtx(ctx, backoff(failures, policyPushMinBackoff, policyPushMaxBackoff))
+				continue
+			}
+			version = v
+		} else if d := time.Since(start); d < policyPushMinBackoff {
+			// a server that does not hold the request must not make us spin
+			sleepCtx(ctx, policyPushMinBackoff-d)
+		}
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// waitPolicyVersion makes one watch request. It reports the current policy
+// version and whether it differs from known; the server answers 304 when its
+// wait ran out without a change.
+func (s *Service) waitPolicyVersion(ctx context.Context, c *http.Client, known string) (string, bool, error) {
+	u, err := url.Parse(s.cfg.PolicyPushURL)
+	if err != nil {
+		return "", false, err
+	}
+	q := u.Query()
+	q.Set("wait", strconv.Itoa(int(policyPushWait.Seconds())))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	if known != "" {
+		req.Header.Set("If-None-Match", known)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return known, false, nil
+	case resp.StatusCode >= 300:
+		return "", false, fmt.Errorf("policy push returned status %d", resp.StatusCode)
+	}
+	var body struct {
+		Version string `json:"version"`
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", false, err
+	}
+	// the version may come in the body or as the ETag; a bare notification
+	// without either still triggers a fetch
+	if json.Unmarshal(b, &body) != nil || body.Version == "" {
+		body.Version = resp.Header.Get("ETag")
+	}
+	return body.Version, true, nil
+}
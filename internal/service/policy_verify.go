@@ -0,0 +1,70 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/policy"
+)
+
+// maxSignatureBytes bounds the detached signature download.
+const maxSignatureBytes = 64 << 10
+
+// verifyPolicy checks the detached signature of a fetched policy document
+// against the trusted keys, and its serial against the last document stored
+// from source, and returns the signature. Without trusted keys nothing is
+// checked and the signature is empty. A failure is recorded as a
+// policy_verification_failed event, once per document and reason. Callers hold
+// polMu.
+func (s *Service) verifyPolicy(source string, doc []byte) (policy.Signature, error) {
+	if len(s.keys) == 0 {
+		return policy.Signature{}, nil
+	}
+	sig, err := s.checkSignature(doc)
+	if err == nil {
+		err = s.pol.CheckSerial(source, sig.Serial, policy.Hash(string(doc)))
+	}
+	if err != nil {
+		hash := policy.Hash(string(doc))
+		if s.badSig == hash+err.Error() {
+			return policy.Signature{}, fmt.Errorf("policy verification failed: %w", err)
+		}
+		s.badSig = hash + err.Error()
+		payload, _ := json.Marshal(map[string]any{
+			"policy_url":    s.cfg.PolicyURL,
+			"signature_url": s.cfg.PolicySignatureURL,
+			"key_id":        sig.KeyID,
+			"serial":        sig.Serial,
+			"hash":          hash,
+			"reason":        err.Error(),
+		})
+		s.emit(events.Event{Timestamp: time.Now().UTC(), Type: "policy_verification_failed", Severity: events.SeverityHigh, Module: "policy", Payload: string(payload)})
+		return policy.Signature{}, fmt.Errorf("policy verification failed: %w", err)
+	}
+	s.badSig = ""
+	return sig, nil
+}
+
+func (s *Service) checkSignature(doc []byte) (policy.Signature, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.cfg.PolicySignatureURL, nil)
+	if err != nil {
+		return policy.Signature{}, err
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return policy.Signature{}, fmt.Errorf("fetch signature: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return policy.Signature{}, fmt.Errorf("fetch signature: status %d", resp.StatusCode)
+	}
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureBytes))
+	if err != nil {
+		return policy.Signature{}, fmt.Errorf("read signature: %w", err)
+	}
+	return s.keys.Verify(doc, sig)
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"sentinel-agent/internal/events"
+)
+
+func (s *Service) retentionPolicy() events.RetentionPolicy {
+	p := events.RetentionPolicy{TypeTTL: map[string]time.Duration{}}
+	if s.cfg.RetentionMaxAgeDays > 0 {
+		p.MaxAge = time.Duration(s.cfg.RetentionMaxAgeDays) * 24 * time.Hour
+	}
+	if s.cfg.RetentionMaxRows > 0 {
+		p.MaxRows = s.cfg.RetentionMaxRows
+	}
+	if s.cfg.RetentionMaxDBMB > 0 {
+		p.MaxBytes = s.cfg.RetentionMaxDBMB * 1024 * 1024
+	}
+	for typ, hours := range s.cfg.RetentionTypeTTLHours {
+		if hours > 0 {
+			p.TypeTTL[typ] = time.Duration(hours) * time.Hour
+		}
+	}
+	return p
+}
+
+// pruneOnce enforces the retention policy and records an events_pruned audit event.
+func (s *Service) pruneOnce() {
+	res, err := s.store.Prune(s.retentionPolicy(), time.Now().UTC())
+	if err != nil {
+		s.log.Error("event prune failed", "err", err)
+	}
+	if res.Total == 0 {
+		return
+	}
+	s.log.Info("events pruned", "total", res.Total)
+	b, _ := json.Marshal(res)
+	s.emit(events.Event{Timestamp: time.Now().UTC(), Type: "events_pruned", Module: "retention", Payload: string(b)})
+}
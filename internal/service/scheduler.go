@@ -1,12 +1,16 @@
 package service
 
 import (
+	"sync"
 	"time"
 )
 
-// RunEvery starts a goroutine that runs fn every interval until stop channel is closed.
-func RunEvery(interval time.Duration, stop <-chan struct{}, fn func()) {
+// RunEvery starts a goroutine that runs fn every interval until stop channel is
+// closed; wg tracks the goroutine so callers can wait for a run in progress.
+func RunEvery(interval time.Duration, stop <-chan struct{}, wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
@@ -2,55 +2,86 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"gopkg.in/yaml.v3"
-
 	"sentinel-agent/internal/config"
 	"sentinel-agent/internal/events"
 	"sentinel-agent/internal/gateway"
 	"sentinel-agent/internal/logging"
 	"sentinel-agent/internal/modules"
 	"sentinel-agent/internal/policy"
+	"sentinel-agent/internal/sinks"
+	"sentinel-agent/internal/storage"
+	"sentinel-agent/internal/tasks"
+	"sentinel-agent/internal/transport"
 )
 
 type Service struct {
 	cfg    *config.Config
 	log    *logging.Logger
+	host   string
 	store  events.EventStore
 	gc     gateway.GatewayClient
+	http   *http.Client
+	sinks  *sinks.Registry
+	out    *dispatcher
 	mods   *modules.Registry
 	pol    *policy.DBStore
+	keys   policy.KeyRing
+	tasks  *tasks.Store
+	taskCh chan struct{}
+	runMu  sync.Mutex
+	// policy fetches are serialized; etag is the last fetched document's ETag
+	polMu sync.Mutex
+	etag  string
+	// the last verification failure reported, so a bad document is reported once
+	badSig string
+	pushUp atomic.Bool
+	db     *storage.DB
+	dbErr  error
+	// background goroutines started by Run, which closes db only once they return
+	wg     sync.WaitGroup
 	ctx    context.Context
 	cancel context.CancelFunc
 }
 
 func New(cfg *config.Config, logger *logging.Logger) *Service {
 	ctx, cancel := context.WithCancel(context.Background())
-	s := &Service{cfg: cfg, log: logger, ctx: ctx, cancel: cancel}
+	s := &Service{cfg: cfg, log: logger, ctx: ctx, cancel: cancel, taskCh: make(chan struct{}, 1)}
+	s.host, _ = os.Hostname()
 	s.mods = modules.NewRegistry()
 	// register built-in modules
 	s.mods.Register(modules.NewSysInfoModule())
 	s.mods.Register(modules.NewProcessModule())
-	// init policy store and register enforcer
-	if ps, err := policy.NewDBStore(cfg.DBPath); err == nil {
-		s.pol = ps
-		s.mods.Register(modules.NewPolicyEnforcer(ps))
+	// open the shared database and register the enforcer on its policy store
+	if db, err := storage.Open(cfg.DBPath); err == nil {
+		s.db = db
+		s.store = db.Events()
+		s.pol = db.Policies()
+		s.tasks = db.Tasks()
+		s.mods.Register(modules.NewPolicyEnforcer(s.pol))
 		// if no policy exists, seed a default inert policy (detect-only)
 		if s.pol.Get() == nil {
 			defaultPolicy := &policy.Policy{
-				ID:   "active",
-				Name: "default",
-				Raw:  `{"version":1,"rules":[{"id":"p1","type":"block_process","match":"cmd.exe","action":"alert"},{"id":"p2","type":"block_process","match":"notepad.exe","action":"alert"}]}`,
+				ID:     "active",
+				Name:   "default",
+				Source: "default",
+				Raw:    `{"version":1,"rules":[{"id":"p1","type":"block_process","match":"cmd.exe","action":"alert"},{"id":"p2","type":"block_process","match":"notepad.exe","action":"alert"}]}`,
 			}
 			_ = s.pol.Set(defaultPolicy)
 		}
 	} else {
-		// log but continue without policy enforcement
-		s.log.Error("failed to open policy store", "err", err)
+		// Run refuses to start without a database
+		s.dbErr = err
+		s.log.Error("failed to open database", "err", err)
 	}
 	return s
 }
@@ -58,9 +89,84 @@ func New(cfg *config.Config, logger *logging.Logger) *Service {
 func (s *Service) Run() {
 	s.log.Info("service starting")
 
-	// start background policy fetcher if configured
+	// this includes a database migrated by a newer agent, which must not be
+	// written by this one
+	if s.dbErr != nil {
+		s.log.Error("refusing to start", "err", s.dbErr)
+		return
+	}
+	defer func() {
+		s.cancel()
+		s.wg.Wait()
+		s.db.Close()
+	}()
+
+	// shared authenticated HTTP client for the gateway and policy server
+	hc, err := transport.NewHTTPClient(s.cfg)
+	if err != nil {
+		s.log.Error("refusing to start: invalid transport configuration", "err", err)
+		return
+	}
+	s.http = hc
+
+	if !policy.InitialState(s.cfg.PolicyDefaultState) {
+		s.log.Error("refusing to start: invalid policy_default_state", "state", s.cfg.PolicyDefaultState)
+		return
+	}
+
+	// keys trusted to sign fetched policies; none means policies are unsigned
+	s.keys = policy.KeyRing{}
+	for _, k := range s.cfg.PolicyKeys {
+		if err := s.keys.Add(k.ID, k.PublicKey); err != nil {
+			s.log.Error("refusing to start: invalid policy key", "err", err)
+			return
+		}
+	}
+
+	// build the output sinks; modules get the default gateway sink, if any
+	if s.sinks, err = sinks.FromConfig(s.cfg, s.http, s.store); err != nil {
+		s.log.Error("refusing to start: invalid sink configuration", "err", err)
+		return
+	}
+	if gc, ok := s.sinks.Get(sinks.DefaultName); ok {
+		s.gc = gc
+	}
+	for _, name := range s.sinks.Names() {
+		sink, _ := s.sinks.Get(name)
+		if n, ok := sink.(gateway.StateNotifier); ok {
+			n.OnStateChange(s.gatewayStateChanged(name))
+		}
+		// gateways may answer uploads with tasks for this agent
+		if r, ok := sink.(gateway.TaskReceiver); ok {
+			r.OnTasks(s.receiveTasks(name))
+		}
+	}
+	if n, err := s.store.AbandonSinks(s.sinks.Names()); err != nil {
+		s.log.Error("failed to abandon deliveries to removed sinks", "err", err)
+	} else if n > 0 {
+		s.log.Info("abandoned deliveries to removed sinks", "count", n)
+	}
+
+	// route stored events to the sinks and deliver to each in the background,
+	// so a slow or unreachable sink never stalls the module loop or the others
+	s.out = newDispatcher(s.store, s.sinks.Route, s.log, s.cfg.DeliveryBatchSize)
+	for _, name := range s.sinks.Names() {
+		sink, _ := s.sinks.Get(name)
+		o := newOutbox(s.store, name, sink, s.log, s.cfg.DeliveryBatchSize, s.cfg.DeliveryMaxAttempts,
+			time.Duration(s.cfg.DeliveryMaxBackoffSeconds)*time.Second)
+		s.out.outs = append(s.out.outs, o)
+		s.spawn(func() { o.run(s.ctx) })
+	}
+	s.spawn(func() { s.out.run(s.ctx) })
+	s.spawn(func() { s.runTasks(s.ctx) })
+
+	// start background policy fetcher if configured; while the push channel
+	// is connected the poll is skipped
 	if s.cfg.PolicyURL != "" && s.pol != nil {
-		go func() {
+		if s.cfg.PolicyPushURL != "" {
+			s.spawn(func() { s.watchPolicy(s.ctx) })
+		}
+		s.spawn(func() {
 			// fetch once immediately, then on ticker
 			s.fetchPolicyOnce()
 			ticker := time.NewTicker(time.Duration(s.cfg.PolicyPollSeconds) * time.Second)
@@ -68,25 +174,25 @@ func (s *Service) Run() {
 			for {
 				select {
 				case <-ticker.C:
-					s.fetchPolicyOnce()
+					if !s.pushUp.Load() {
+						s.fetchPolicyOnce()
+					}
 				case <-s.ctx.Done():
 					return
 				}
 			}
-		}()
+		})
 	}
 
-	// initialize store
-	store, err := events.NewSqliteStore(s.cfg.DBPath)
-	if err != nil {
-		s.log.Error("failed to open event store", "err", err)
-		return
+	// staged policies go live once their grace period has passed
+	if s.cfg.PolicyStagingGraceSeconds > 0 {
+		s.promoteStaged()
+		RunEvery(time.Minute, s.ctx.Done(), &s.wg, s.promoteStaged)
 	}
-	defer store.Close()
-	s.store = store
 
-	// initialize gateway client
-	s.gc = gateway.NewHTTPClient(s.cfg.GatewayURL)
+	// enforce retention now and then periodically
+	s.pruneOnce()
+	RunEvery(time.Duration(s.cfg.RetentionIntervalSeconds)*time.Second, s.ctx.Done(), &s.wg, s.pruneOnce)
 
 	// initial run
 	s.runOnce()
@@ -105,80 +211,160 @@ func (s *Service) Run() {
 }
 
 func (s *Service) fetchPolicyOnce() {
+	if err := s.fetchPolicy(); err != nil {
+		s.log.Error("policy fetch failed", "err", err)
+	}
+}
+
+// fetchPolicy downloads the policy document from PolicyURL and stores each
+// policy in it. The document is skipped when its ETag has not changed.
+func (s *Service) fetchPolicy() error {
 	if s.cfg.PolicyURL == "" || s.pol == nil {
-		return
+		return fmt.Errorf("no policy_url configured")
 	}
+	s.polMu.Lock()
+	defer s.polMu.Unlock()
 	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, s.cfg.PolicyURL, nil)
 	if err != nil {
-		s.log.Error("policy fetch request failed", "err", err)
-		return
+		return err
 	}
-	client := &http.Client{Timeout: 15 * time.Second}
-	resp, err := client.Do(req)
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := s.http.Do(req)
 	if err != nil {
-		s.log.Error("policy fetch failed", "err", err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
 	if resp.StatusCode >= 400 {
-		s.log.Error("policy fetch returned status", "status", resp.StatusCode)
-		return
+		return fmt.Errorf("policy server returned status %d", resp.StatusCode)
 	}
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		s.log.Error("policy read failed", "err", err)
-		return
+		return fmt.Errorf("read policy: %w", err)
 	}
-	// parse YAML to ensure it's valid and split into policies
-	var doc struct {
-		Version  int              `yaml:"version"`
-		Policies []map[string]any `yaml:"policies"`
+	source := "url:" + s.cfg.PolicyURL
+	sig, err := s.verifyPolicy(source, b)
+	if err != nil {
+		return err
 	}
-	if err := yaml.Unmarshal(b, &doc); err != nil {
-		s.log.Error("policy yaml parse failed", "err", err)
-		return
+	// validate the whole document before storing any of it
+	doc, err := policy.Parse(b)
+	if err != nil {
+		return fmt.Errorf("policy rejected: %w", err)
 	}
-	// store each policy by id
-	for _, p := range doc.Policies {
-		id, _ := p["id"].(string)
-		name, _ := p["name"].(string)
-		// canonicalize to JSON for storage
-		rawMap := map[string]any{"version": doc.Version, "id": id, "name": name, "rules": p["rules"]}
-		jb, _ := json.Marshal(rawMap)
-		pol := &policy.Policy{ID: id, Name: name, Raw: string(jb), Updated: time.Now().UTC()}
+	failed := 0
+	for _, pol := range doc.Stored(source, time.Now()) {
+		pol.Verified, pol.KeyID = sig.KeyID != "", sig.KeyID
+		if pol.State == "" {
+			pol.State = s.cfg.PolicyDefaultState
+		}
+		// an operator rolled this content back; wait for a new version
+		if s.pol.RolledBack(pol.ID, policy.Hash(pol.Raw)) {
+			s.log.Info("skipping rolled back policy", "id", pol.ID)
+			continue
+		}
 		if err := s.pol.Set(pol); err != nil {
-			s.log.Error("failed to set policy", "id", id, "err", err)
+			s.log.Error("failed to set policy", "id", pol.ID, "err", err)
+			failed++
 		} else {
-			s.log.Info("policy stored", "id", id)
+			s.log.Info("policy stored", "id", pol.ID, "revision", pol.Revision, "state", pol.State)
 		}
 	}
+	// keep the old ETag so the next fetch retries the whole document
+	if failed > 0 {
+		return fmt.Errorf("%d policies not stored", failed)
+	}
+	if sig.Serial > 0 {
+		if err := s.pol.SetSerial(source, sig.Serial, policy.Hash(string(b)), time.Now()); err != nil {
+			return fmt.Errorf("record policy serial: %w", err)
+		}
+	}
+	s.etag = resp.Header.Get("ETag")
+	return nil
 }
 
 func (s *Service) runOnce() {
 	s.log.Info("running modules")
-	ctx := s.ctx
-	mods := s.mods.List()
-	for _, m := range mods {
-		s.log.Info("running module", "module", m.Name())
-		if evts, err := m.Run(ctx, s.cfg, s.store, s.gc, s.log); err != nil {
-			s.log.Error("module run error", "module", m.Name(), "err", err)
-		} else if len(evts) > 0 {
-			// persist events
-			for _, e := range evts {
-				if err := s.store.Save(e); err != nil {
-					s.log.Error("failed to save event", "err", err)
-				}
-			}
-			// attempt to send
-			if s.gc != nil {
-				if err := s.gc.SendEvents(ctx, evts); err != nil {
-					s.log.Error("gateway send failed", "err", err)
-				}
-			}
+	for _, m := range s.mods.List() {
+		s.runModule(m)
+	}
+}
+
+// runModule runs m once and stores its events, returning how many it produced.
+// Module runs are serialized so tasks cannot overlap the poll loop.
+func (s *Service) runModule(m modules.Module) int {
+	s.runMu.Lock()
+	defer s.runMu.Unlock()
+	s.log.Info("running module", "module", m.Name())
+	evts, err := m.Run(s.ctx, s.cfg, s.store, s.gc, s.log)
+	if err != nil {
+		s.log.Error("module run error", "module", m.Name(), "err", err)
+		return 0
+	}
+	if len(evts) == 0 {
+		return 0
+	}
+	// persist the module's events in one transaction
+	corr := newID()
+	for i := range evts {
+		if evts[i].Module == "" {
+			evts[i].Module = m.Name()
 		}
+		s.stamp(&evts[i], corr)
+	}
+	if err := s.store.SaveBatch(evts); err != nil {
+		s.log.Error("failed to save events", "module", m.Name(), "count", len(evts), "err", err)
+		return 0
+	}
+	// hand off to the sinks for delivery
+	s.out.Notify()
+	return len(evts)
+}
+
+// stamp fills the envelope fields the service owns. Events produced by one
+// module run share a correlation ID unless the module set its own.
+func (s *Service) stamp(e *events.Event, correlationID string) {
+	e.AgentID = s.cfg.AgentID
+	e.Hostname = s.host
+	e.SchemaVersion = events.SchemaVersion
+	if e.Severity == "" {
+		e.Severity = events.SeverityInfo
+	}
+	if e.CorrelationID == "" {
+		e.CorrelationID = correlationID
 	}
 }
 
+// emit stamps and stores an event raised by the service itself and hands it
+// to the sinks.
+func (s *Service) emit(e events.Event) {
+	s.stamp(&e, newID())
+	if err := s.store.Save(e); err != nil {
+		s.log.Error("failed to save event", "type", e.Type, "err", err)
+		return
+	}
+	s.out.Notify()
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// spawn runs fn in a goroutine that Run waits for before closing the database.
+func (s *Service) spawn(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
 func (s *Service) Stop() {
 	s.cancel()
 }
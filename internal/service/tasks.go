@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/tasks"
+)
+
+// receiveTasks returns the callback that records tasks delivered by the named
+// sink and wakes the task runner. Refused tasks are reported straight away.
+func (s *Service) receiveTasks(sink string) func([]tasks.Task) {
+	return func(ts []tasks.Task) {
+		now := time.Now()
+		for _, t := range ts {
+			fresh, err := s.tasks.Receive(sink, t, now)
+			if err != nil {
+				s.log.Error("failed to record task", "id", t.ID, "err", err)
+				continue
+			}
+			if !fresh {
+				// redelivered by the gateway; it already ran or is queued
+				continue
+			}
+			if t.Invalid != "" {
+				s.log.Error("task rejected", "id", t.ID, "type", t.Type, "reason", t.Invalid)
+				s.taskResult(tasks.Record{Task: t, Sink: sink}, tasks.StateRejected, t.Invalid, nil)
+				continue
+			}
+			s.log.Info("task received", "id", t.ID, "type", t.Type, "sink", sink)
+		}
+		notify(s.taskCh)
+	}
+}
+
+// runTasks executes received tasks one at a time, oldest first.
+func (s *Service) runTasks(ctx context.Context) {
+	// tasks cut short by a restart are reported, not re-run
+	if recs, err := s.tasks.Interrupted(time.Now()); err != nil {
+		s.log.Error("task recovery failed", "err", err)
+	} else {
+		for _, r := range recs {
+			s.taskResult(r, tasks.StateFailed, "interrupted", nil)
+		}
+	}
+	for {
+		for ctx.Err() == nil {
+			r, err := s.tasks.Claim()
+			if err != nil {
+				s.log.Error("task claim failed", "err", err)
+				break
+			}
+			if r == nil {
+				break
+			}
+			s.runTask(*r)
+		}
+		select {
+		case <-s.taskCh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Service) runTask(r tasks.Record) {
+	s.log.Info("running task", "id", r.ID, "type", r.Type)
+	var result any
+	var err error
+	if r.Expires > 0 && time.Now().Unix() > r.Expires {
+		err = fmt.Errorf("expired before it ran")
+	} else {
+		result, err = s.execTask(r)
+	}
+	state, msg := tasks.StateDone, ""
+	if err != nil {
+		state, msg = tasks.StateFailed, err.Error()
+		s.log.Error("task failed", "id", r.ID, "type", r.Type, "err", err)
+	}
+	stored := msg
+	if err == nil && result != nil {
+		b, _ := json.Marshal(result)
+		stored = string(b)
+	}
+	if err := s.tasks.Finish(r.ID, state, stored, time.Now()); err != nil {
+		s.log.Error("failed to record task result", "id", r.ID, "err", err)
+	}
+	s.taskResult(r, state, msg, result)
+}
+
+func (s *Service) execTask(r tasks.Record) (any, error) {
+	switch r.Type {
+	case tasks.TypeRunModule:
+		var args struct {
+			Module string `json:"module"`
+		}
+		if err := taskArgs(r, &args); err != nil {
+			return nil, err
+		}
+		for _, m := range s.mods.List() {
+			if m.Name() == args.Module {
+				return map[string]any{"module": m.Name(), "events": s.runModule(m)}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown module %q", args.Module)
+	case tasks.TypeRefetchPolicy:
+		return nil, s.fetchPolicy()
+	case tasks.TypeUploadEvents:
+		var args struct {
+			Since time.Time `json:"since"`
+		}
+		if err := taskArgs(r, &args); err != nil {
+			return nil, err
+		}
+		if _, ok := s.sinks.Get(r.Sink); !ok {
+			return nil, fmt.Errorf("sink %q is no longer configured", r.Sink)
+		}
+		n, err := s.store.Redeliver(r.Sink, args.Since)
+		if err != nil {
+			return nil, err
+		}
+		s.out.wakeSinks()
+		return map[string]any{"queued": n}, nil
+	case tasks.TypeSetLogLevel:
+		var args struct {
+			Level string `json:"level"`
+		}
+		if err := taskArgs(r, &args); err != nil {
+			return nil, err
+		}
+		if err := s.log.SetLevel(args.Level); err != nil {
+			return nil, err
+		}
+		return map[string]any{"level": s.log.Level()}, nil
+	}
+	return nil, fmt.Errorf("unknown task type %q", r.Type)
+}
+
+func taskArgs(r tasks.Record, v any) error {
+	if len(r.Args) == 0 {
+		return fmt.Errorf("%s task needs args", r.Type)
+	}
+	if err := json.Unmarshal(r.Args, v); err != nil {
+		return fmt.Errorf("invalid %s args: %w", r.Type, err)
+	}
+	return nil
+}
+
+// taskResult reports a task's outcome to the server as a task_result event.
+func (s *Service) taskResult(r tasks.Record, state, msg string, result any) {
+	payload := map[string]any{"task_id": r.ID, "task_type": r.Type, "sink": r.Sink, "status": state}
+	if msg != "" {
+		payload["error"] = msg
+	}
+	if result != nil {
+		payload["result"] = result
+	}
+	sev := events.SeverityInfo
+	if state != tasks.StateDone {
+		sev = events.SeverityLow
+	}
+	b, _ := json.Marshal(payload)
+	s.emit(events.Event{Timestamp: time.Now().UTC(), Type: "task_result", Severity: sev, Module: "tasks", Payload: string(b)})
+}
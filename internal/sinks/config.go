@@ -0,0 +1,90 @@
+package sinks
+
+import (
+	"fmt"
+	"net/http"
+
+	"sentinel-agent/internal/config"
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+	"sentinel-agent/internal/transport"
+)
+
+// DefaultName is the sink used when the config lists none: the HTTP gateway at gateway_url.
+const DefaultName = "gateway"
+
+// FromConfig builds the registry described by cfg.Sinks. HTTP sinks share c
+// and number their uploads from counters in store.
+func FromConfig(cfg *config.Config, c *http.Client, store events.EventStore) (*Registry, error) {
+	scs := cfg.Sinks
+	if len(scs) == 0 {
+		scs = []config.SinkConfig{{Name: DefaultName, Type: "http"}}
+	}
+	r := NewRegistry()
+	for _, sc := range scs {
+		name := sc.Name
+		if name == "" {
+			name = sc.Type
+		}
+		switch sc.MinSeverity {
+		case "", events.SeverityInfo, events.SeverityLow, events.SeverityMedium, events.SeverityHigh, events.SeverityCritical:
+		default:
+			return nil, fmt.Errorf("sink %q: unknown min_severity %q", name, sc.MinSeverity)
+		}
+		var s Sink
+		var err error
+		switch sc.Type {
+		case "http":
+			s, err = newHTTP(cfg, sc, name, c, store)
+		case "file":
+			if sc.Path == "" {
+				return nil, fmt.Errorf("sink %q: file sink needs a path", name)
+			}
+			s = NewFile(sc.Path)
+		case "syslog":
+			var d transport.DialFunc
+			if d, err = transport.Dialer(cfg); err == nil {
+				s, err = NewSyslog(d, sc.Network, sc.Address, sc.Facility)
+			}
+		default:
+			return nil, fmt.Errorf("sink %q: unknown type %q", name, sc.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", name, err)
+		}
+		if err := r.Register(name, s, Filter{Types: sc.Types, MinSeverity: sc.MinSeverity}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// newHTTP returns a gateway client for sc. Sinks other than the default one
+// keep their own upload sequence so each gateway sees gap-free numbering.
+func newHTTP(cfg *config.Config, sc config.SinkConfig, name string, c *http.Client, store events.EventStore) (Sink, error) {
+	hc := *cfg
+	if sc.URL != "" {
+		hc.GatewayURL = sc.URL
+	}
+	seq := deliverySequencer{store: store, sink: name, counter: "gateway_upload"}
+	if name != DefaultName {
+		seq.counter += ":" + name
+	}
+	return gateway.NewHTTPClient(&hc, c, seq)
+}
+
+// deliverySequencer numbers a sink's upload batches and records each number
+// on the batch's deliveries.
+type deliverySequencer struct {
+	store   events.EventStore
+	sink    string
+	counter string
+}
+
+func (d deliverySequencer) AssignSequence(ids []int64) (int64, error) {
+	return d.store.AssignSequence(d.sink, d.counter, ids)
+}
+
+func (d deliverySequencer) ReleaseSequence(ids []int64) error {
+	return d.store.ReleaseSequence(d.sink, ids)
+}
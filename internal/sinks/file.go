@@ -0,0 +1,75 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+)
+
+// fileSink appends events to a local file as newline-delimited JSON. The file
+// is reopened for every batch so external log rotation is picked up.
+type fileSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFile(path string) Sink {
+	return &fileSink{path: path}
+}
+
+func (f *fileSink) SendEvents(ctx context.Context, evts []events.Event) ([]gateway.BatchResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := gateway.BatchResult{IDs: ids(evts)}
+	res.Err = f.write(evts, &res.Bytes)
+	if res.Err != nil {
+		return []gateway.BatchResult{res}, res.Err
+	}
+	res.Accepted = res.IDs
+	return []gateway.BatchResult{res}, nil
+}
+
+func (f *fileSink) write(evts []events.Event, n *int) error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	fh, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	w := bufio.NewWriter(fh)
+	for _, e := range evts {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		b = append(b, '\n')
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		*n += len(b)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// the events count as delivered only once they are on disk
+	if err := fh.Sync(); err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+func ids(evts []events.Event) []int64 {
+	out := make([]int64, len(evts))
+	for i, e := range evts {
+		out[i] = e.ID
+	}
+	return out
+}
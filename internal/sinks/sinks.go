@@ -0,0 +1,99 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+)
+
+// Sink delivers events to one destination and reports, per batch, which
+// events it took. It has the same shape as gateway.GatewayClient so every
+// sink's results are handled alike.
+type Sink interface {
+	SendEvents(ctx context.Context, evts []events.Event) ([]gateway.BatchResult, error)
+}
+
+// Filter selects the events a sink receives. Empty fields match everything.
+type Filter struct {
+	Types       []string
+	MinSeverity string
+}
+
+func (f Filter) Match(e events.Event) bool {
+	if f.MinSeverity != "" && events.SeverityRank(e.Severity) < events.SeverityRank(f.MinSeverity) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type entry struct {
+	name   string
+	sink   Sink
+	filter Filter
+}
+
+// Registry holds the named sinks events are fanned out to.
+type Registry struct {
+	mu    sync.RWMutex
+	sinks []entry
+}
+
+func NewRegistry() *Registry { return &Registry{} }
+
+func (r *Registry) Register(name string, s Sink, f Filter) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.sinks {
+		if e.name == name {
+			return fmt.Errorf("duplicate sink name %q", name)
+		}
+	}
+	r.sinks = append(r.sinks, entry{name: name, sink: s, filter: f})
+	return nil
+}
+
+// Names returns the registered sink names in registration order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, len(r.sinks))
+	for i, e := range r.sinks {
+		out[i] = e.name
+	}
+	return out
+}
+
+func (r *Registry) Get(name string) (Sink, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, e := range r.sinks {
+		if e.name == name {
+			return e.sink, true
+		}
+	}
+	return nil, false
+}
+
+// Route returns the names of the sinks whose filter matches e.
+func (r *Registry) Route(e events.Event) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []string
+	for _, s := range r.sinks {
+		if s.filter.Match(e) {
+			out = append(out, s.name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,156 @@
+package sinks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+	"sentinel-agent/internal/transport"
+)
+
+const (
+	syslogApp     = "sentinel-agent"
+	syslogTimeout = 10 * time.Second
+	// maxDatagram keeps UDP messages inside a single IPv4 datagram
+	maxDatagram = 65000
+	// syslogSDID is the structured-data element carrying the event envelope
+	// (32473 is the private enterprise number reserved for examples)
+	syslogSDID = "sentinel@32473"
+	// facility local0
+	defaultFacility = 16
+)
+
+// syslogSink sends each event as an RFC 5424 message with the payload as
+// the message body. TCP uses octet-counting framing (RFC 6587).
+type syslogSink struct {
+	dial     transport.DialFunc
+	network  string
+	address  string
+	facility int
+	host     string
+}
+
+// NewSyslog returns a sink for the syslog server at address, connecting with
+// dial so the agent's source address and dial timeout apply.
+func NewSyslog(dial transport.DialFunc, network, address string, facility int) (Sink, error) {
+	if network == "" {
+		network = "udp"
+	}
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("syslog network must be udp or tcp, got %q", network)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("syslog sink needs an address")
+	}
+	if facility == 0 {
+		facility = defaultFacility
+	}
+	if facility < 0 || facility > 23 {
+		return nil, fmt.Errorf("syslog facility %d out of range", facility)
+	}
+	host, _ := os.Hostname()
+	return &syslogSink{dial: dial, network: network, address: address, facility: facility, host: host}, nil
+}
+
+// SendEvents writes evts over one connection. Events written before a
+// failure count as delivered; the rest are reported failed and retried.
+func (s *syslogSink) SendEvents(ctx context.Context, evts []events.Event) ([]gateway.BatchResult, error) {
+	conn, err := s.dial(ctx, s.network, s.address)
+	if err != nil {
+		return []gateway.BatchResult{{IDs: ids(evts), Err: err}}, err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	done := gateway.BatchResult{}
+	for i, e := range evts {
+		msg := s.format(e)
+		if s.network == "tcp" {
+			msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+		}
+		if _, err := conn.Write(msg); err != nil {
+			rest := gateway.BatchResult{IDs: ids(evts[i:]), Err: err}
+			return []gateway.BatchResult{done, rest}, err
+		}
+		done.IDs = append(done.IDs, e.ID)
+		done.Bytes += len(msg)
+	}
+	done.Accepted = done.IDs
+	return []gateway.BatchResult{done}, nil
+}
+
+// format renders e as an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+func (s *syslogSink) format(e events.Event) []byte {
+	host := e.Hostname
+	if host == "" {
+		host = s.host
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s", s.facility*8+syslogSeverity(e.Severity),
+		e.Timestamp.UTC().Format(time.RFC3339), header(host, 255), syslogApp, os.Getpid(), header(e.Type, 32), syslogSDID)
+	for _, p := range [][2]string{
+		{"id", strconv.FormatInt(e.ID, 10)},
+		{"severity", e.Severity},
+		{"module", e.Module},
+		{"agent_id", e.AgentID},
+		{"correlation_id", e.CorrelationID},
+	} {
+		if p[1] != "" {
+			fmt.Fprintf(&b, ` %s="%s"`, p[0], sdEscape.Replace(p[1]))
+		}
+	}
+	// the BOM marks the message body as UTF-8
+	b.WriteString("] \ufeff")
+	payload := e.Payload
+	if s.network == "udp" && b.Len()+len(payload) > maxDatagram {
+		// cut on a rune boundary so the body stays valid UTF-8
+		n := max(maxDatagram-b.Len(), 0)
+		for n > 0 && !utf8.RuneStart(payload[n]) {
+			n--
+		}
+		payload = payload[:n]
+	}
+	b.WriteString(payload)
+	return []byte(b.String())
+}
+
+var sdEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// header makes s a valid RFC 5424 header field: printable ASCII without
+// spaces, at most n bytes, "-" when empty.
+func header(s string, n int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > n {
+		s = s[:n]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// syslogSeverity maps event severities onto syslog severity codes.
+func syslogSeverity(sev string) int {
+	switch sev {
+	case events.SeverityCritical:
+		return 2
+	case events.SeverityHigh:
+		return 3
+	case events.SeverityMedium:
+		return 4
+	case events.SeverityLow:
+		return 5
+	}
+	return 6
+}
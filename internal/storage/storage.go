@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"database/sql"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	_ "modernc.org/sqlite"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/policy"
+	"sentinel-agent/internal/tasks"
+)
+
+const (
+	busyTimeoutMillis = 5000
+	maxOpenConns      = 4
+)
+
+// DB owns the single connection pool to the agent database and hands out the
+// stores built on it. The service, its background goroutines and the CLI tools
+// all go through it so that every connection runs in WAL mode with a busy
+// timeout and writers wait for each other instead of failing with SQLITE_BUSY.
+type DB struct {
+	db       *sql.DB
+	events   events.EventStore
+	policies *policy.DBStore
+	tasks    *tasks.Store
+}
+
+// Open opens (or creates) the database at path and runs all schema migrations.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "busy_timeout("+strconv.Itoa(busyTimeoutMillis)+")")
+	q.Add("_pragma", "foreign_keys(1)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	// take the write lock when a transaction starts so read-then-write
+	// transactions wait on busy_timeout rather than deadlocking
+	q.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+	d := &DB{db: db}
+	if d.events, err = events.NewSqliteStore(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if d.policies, err = policy.NewDBStore(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if d.tasks, err = tasks.NewStore(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DB) Events() events.EventStore { return d.events }
+func (d *DB) Policies() *policy.DBStore { return d.policies }
+func (d *DB) Tasks() *tasks.Store       { return d.tasks }
+func (d *DB) Close() error              { return d.db.Close() }
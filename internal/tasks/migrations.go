@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"database/sql"
+
+	"sentinel-agent/internal/migrate"
+)
+
+// migrations is the ordered schema history of the tasks table. Append only.
+var migrations = []migrate.Migration{
+	{Version: 1, Name: "create_tasks", Up: func(tx *sql.Tx) error {
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS tasks (
+            id TEXT PRIMARY KEY,
+            sink TEXT NOT NULL,
+            type TEXT NOT NULL,
+            args TEXT NOT NULL DEFAULT '',
+            issued INTEGER NOT NULL,
+            expires INTEGER NOT NULL DEFAULT 0,
+            signature TEXT NOT NULL DEFAULT '',
+            state TEXT NOT NULL,
+            result TEXT NOT NULL DEFAULT '',
+            received TEXT NOT NULL,
+            finished TEXT NOT NULL DEFAULT ''
+        );
+        CREATE INDEX IF NOT EXISTS idx_tasks_state ON tasks(state, received);`)
+		return err
+	}},
+	{Version: 2, Name: "rejected_tasks", Up: func(tx *sql.Tx) error {
+		// refused tasks are kept apart so a forged task cannot claim the ID
+		// of a genuine one; the same forgery is only recorded once
+		if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS rejected_tasks (
+            task_id TEXT NOT NULL,
+            sink TEXT NOT NULL,
+            type TEXT NOT NULL,
+            args TEXT NOT NULL DEFAULT '',
+            issued INTEGER NOT NULL,
+            expires INTEGER NOT NULL DEFAULT 0,
+            signature TEXT NOT NULL DEFAULT '',
+            reason TEXT NOT NULL,
+            received TEXT NOT NULL,
+            UNIQUE(task_id, signature)
+        )`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO rejected_tasks(task_id, sink, type, args, issued, expires, signature, reason, received)
+            SELECT id, sink, type, args, issued, expires, signature, result, received FROM tasks WHERE state = 'rejected'`); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`DELETE FROM tasks WHERE state = 'rejected'`)
+		return err
+	}},
+}
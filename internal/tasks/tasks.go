@@ -0,0 +1,162 @@
+package tasks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"sentinel-agent/internal/migrate"
+)
+
+// Task types the agent knows how to execute.
+const (
+	TypeRunModule     = "run_module"
+	TypeRefetchPolicy = "refetch_policy"
+	TypeUploadEvents  = "upload_events"
+	TypeSetLogLevel   = "set_log_level"
+)
+
+// Task states recorded in the audit table.
+const (
+	StateReceived = "received"
+	StateRejected = "rejected"
+	StateRunning  = "running"
+	StateDone     = "done"
+	StateFailed   = "failed"
+)
+
+// Task is an instruction from the server, delivered in an upload response.
+// Issued and Expires are unix seconds; Signature authenticates the other
+// fields (see gateway.SignTask).
+type Task struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Issued    int64           `json:"issued"`
+	Expires   int64           `json:"expires,omitempty"`
+	Signature string          `json:"signature"`
+	// Invalid is why the agent refused the task, set before it is recorded.
+	Invalid string `json:"-"`
+}
+
+// Record is a task as kept for audit, with what became of it.
+type Record struct {
+	Task
+	Sink     string
+	State    string
+	Result   string
+	Received time.Time
+	Finished time.Time
+}
+
+// Store keeps every task received, whether it ran or not.
+type Store struct {
+	db *sql.DB
+}
+
+// NewStore migrates the tasks table on db, which is owned by the caller.
+func NewStore(db *sql.DB) (*Store, error) {
+	if err := migrate.Run(db, "tasks", migrations); err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Receive records t as delivered by sink. It reports false for a task ID seen
+// before, which must not run again. A task with t.Invalid set is recorded
+// apart from the others, so it never takes the ID of a genuine task; it
+// reports false when the same rejected task was recorded before.
+func (s *Store) Receive(sink string, t Task, now time.Time) (bool, error) {
+	received := now.UTC().Format(time.RFC3339)
+	var res sql.Result
+	var err error
+	if t.Invalid != "" {
+		res, err = s.db.Exec(`INSERT OR IGNORE INTO rejected_tasks(task_id, sink, type, args, issued, expires, signature, reason, received)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, t.ID, sink, t.Type, string(t.Args), t.Issued, t.Expires, t.Signature, t.Invalid, received)
+	} else {
+		res, err = s.db.Exec(`INSERT OR IGNORE INTO tasks(id, sink, type, args, issued, expires, signature, state, result, received)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, '', ?)`, t.ID, sink, t.Type, string(t.Args), t.Issued, t.Expires, t.Signature,
+			StateReceived, received)
+	}
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Claim marks the oldest received task as running and returns it, or nil when none is waiting.
+func (s *Store) Claim() (*Record, error) {
+	rows, err := s.db.Query(`UPDATE tasks SET state = ? WHERE id = (
+            SELECT id FROM tasks WHERE state = ? ORDER BY received, rowid LIMIT 1)
+        RETURNING `+taskColumns, StateRunning, StateReceived)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanRecord(rows)
+}
+
+// Finish records the outcome of a claimed task.
+func (s *Store) Finish(id, state, result string, now time.Time) error {
+	_, err := s.db.Exec(`UPDATE tasks SET state = ?, result = ?, finished = ? WHERE id = ?`,
+		state, result, now.UTC().Format(time.RFC3339), id)
+	return err
+}
+
+// Interrupted fails tasks left running by an agent that stopped mid-task and returns them.
+func (s *Store) Interrupted(now time.Time) ([]Record, error) {
+	rows, err := s.db.Query(`UPDATE tasks SET state = ?, result = 'interrupted', finished = ?
+        WHERE state = ? RETURNING `+taskColumns, StateFailed, now.UTC().Format(time.RFC3339), StateRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *r)
+	}
+	return out, rows.Err()
+}
+
+// List returns the most recently received tasks, newest first.
+func (s *Store) List(limit int) ([]Record, error) {
+	rows, err := s.db.Query(`SELECT `+taskColumns+` FROM tasks ORDER BY received DESC, rowid DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Record{}
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *r)
+	}
+	return out, rows.Err()
+}
+
+const taskColumns = `id, sink, type, args, issued, expires, signature, state, result, received, finished`
+
+func scanRecord(rows *sql.Rows) (*Record, error) {
+	var r Record
+	var args, received, finished string
+	if err := rows.Scan(&r.ID, &r.Sink, &r.Type, &args, &r.Issued, &r.Expires, &r.Signature,
+		&r.State, &r.Result, &received, &finished); err != nil {
+		return nil, err
+	}
+	if args != "" {
+		r.Args = json.RawMessage(args)
+	}
+	r.Received, _ = time.Parse(time.RFC3339, received)
+	r.Finished, _ = time.Parse(time.RFC3339, finished)
+	return &r, nil
+}
@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"sentinel-agent/internal/config"
+)
+
+// DialFunc opens an outbound connection, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dialer returns the dial function for outbound connections: the configured
+// dial timeout and, when bind_address or bind_interface is set, that source
+// address, bound as a TCP or UDP address to match the network dialed.
+func Dialer(cfg *config.Config) (DialFunc, error) {
+	timeout := time.Duration(cfg.DialTimeoutSeconds) * time.Second
+	tcp := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	udp := &net.Dialer{Timeout: timeout}
+	ip, err := sourceIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		// the dialers then only try remote addresses of the same family
+		tcp.LocalAddr = &net.TCPAddr{IP: ip}
+		udp.LocalAddr = &net.UDPAddr{IP: ip}
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if strings.HasPrefix(network, "udp") {
+			return udp.DialContext(ctx, network, address)
+		}
+		return tcp.DialContext(ctx, network, address)
+	}, nil
+}
+
+func sourceIP(cfg *config.Config) (net.IP, error) {
+	switch {
+	case cfg.BindAddress != "" && cfg.BindInterface != "":
+		return nil, fmt.Errorf("set bind_address or bind_interface, not both")
+	case cfg.BindAddress != "":
+		ip := net.ParseIP(cfg.BindAddress)
+		if ip == nil {
+			return nil, fmt.Errorf("bind_address %q is not an IP address", cfg.BindAddress)
+		}
+		return ip, nil
+	case cfg.BindInterface != "":
+		ifc, err := net.InterfaceByName(cfg.BindInterface)
+		if err != nil {
+			return nil, fmt.Errorf("bind_interface: %w", err)
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("bind_interface %s: %w", cfg.BindInterface, err)
+		}
+		var v6 net.IP
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipn.IP.To4() != nil {
+				return ipn.IP, nil
+			}
+			if v6 == nil && !ipn.IP.IsLinkLocalUnicast() {
+				v6 = ipn.IP
+			}
+		}
+		if v6 == nil {
+			return nil, fmt.Errorf("bind_interface %s has no usable address", cfg.BindInterface)
+		}
+		return v6, nil
+	}
+	return nil, nil
+}
+
+// proxyFunc returns the proxy selection for cfg: proxy_url (with credentials
+// from proxy_username and proxy_password_file) or the environment, minus the
+// no_proxy exceptions.
+func proxyFunc(cfg *config.Config) (func(*http.Request) (*url.URL, error), error) {
+	pc := httpproxy.FromEnvironment()
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("proxy_url %q is not a valid URL", cfg.ProxyURL)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("proxy_url must be http or https, got %q", u.Scheme)
+		}
+		if cfg.ProxyUsername != "" {
+			password := ""
+			if cfg.ProxyPasswordFile != "" {
+				if password, err = ReadSecret(cfg.ProxyPasswordFile); err != nil {
+					return nil, fmt.Errorf("proxy password: %w", err)
+				}
+			}
+			// the transport sends these as Proxy-Authorization
+			u.User = url.UserPassword(cfg.ProxyUsername, password)
+		}
+		pc.HTTPProxy, pc.HTTPSProxy = u.String(), u.String()
+	}
+	if len(cfg.NoProxy) > 0 {
+		pc.NoProxy = strings.Join(cfg.NoProxy, ",")
+	}
+	fn := pc.ProxyFunc()
+	return func(r *http.Request) (*url.URL, error) { return fn(r.URL) }, nil
+}
@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"sentinel-agent/internal/config"
+)
+
+// NewHTTPClient builds the client used for all traffic to the gateway and the
+// policy server. It presents the configured client certificate (mTLS), trusts
+// the configured CA bundle, enforces certificate pins, attaches the bearer
+// token to requests for the gateway and policy hosts, and applies the proxy,
+// timeout and source address settings.
+func NewHTTPClient(cfg *config.Config) (*http.Client, error) {
+	tlsCfg, err := TLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := proxyFunc(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dial, err := Dialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = tlsCfg
+	base.Proxy = proxy
+	base.DialContext = dial
+	base.TLSHandshakeTimeout = time.Duration(cfg.TLSHandshakeTimeoutSeconds) * time.Second
+	var rt http.RoundTripper = base
+	if cfg.GatewayTokenFile != "" {
+		token, err := ReadSecret(cfg.GatewayTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("gateway token: %w", err)
+		}
+		urls := []string{cfg.GatewayURL, cfg.PolicyURL, cfg.PolicyPushURL}
+		for _, sc := range cfg.Sinks {
+			urls = append(urls, sc.URL)
+		}
+		rt = &bearerTransport{base: base, token: token, hosts: hosts(urls...)}
+	}
+	return &http.Client{Timeout: time.Duration(cfg.HTTPTimeoutSeconds) * time.Second, Transport: rt}, nil
+}
+
+// TLSConfig returns the client TLS settings described by cfg.
+func TLSConfig(cfg *config.Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCert != "" || cfg.TLSClientKey != "" {
+		if cfg.TLSClientCert == "" || cfg.TLSClientKey == "" {
+			return nil, errors.New("tls_client_cert and tls_client_key must be set together")
+		}
+		if _, err := ReadSecret(cfg.TLSClientKey); err != nil {
+			return nil, fmt.Errorf("client key: %w", err)
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca bundle %s contains no certificates", cfg.TLSCAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if len(cfg.TLSPinnedSHA256) > 0 {
+		pins := map[string]bool{}
+		for _, p := range cfg.TLSPinnedSHA256 {
+			b, err := decodePin(p)
+			if err != nil {
+				return nil, fmt.Errorf("tls pin %q: %w", p, err)
+			}
+			pins[string(b)] = true
+		}
+		// runs after normal chain verification; at least one certificate in
+		// the presented chain must carry a pinned public key
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, c := range cs.PeerCertificates {
+				sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+				if pins[string(sum[:])] {
+					return nil
+				}
+			}
+			return errors.New("no certificate in the server's chain matches a pinned key")
+		}
+	}
+	return tc, nil
+}
+
+// ReadSecret returns the trimmed contents of a secret file. Outside Windows the
+// file must not be accessible to group or others (mode 0600 or stricter).
+func ReadSecret(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0o077 != 0 {
+		return "", fmt.Errorf("%s has mode %o; secret files must be 0600", path, fi.Mode().Perm())
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return s, nil
+}
+
+// decodePin accepts a SHA-256 SPKI pin in base64 (as in HPKP) or hex.
+func decodePin(p string) ([]byte, error) {
+	p = strings.TrimPrefix(p, "sha256/")
+	if b, err := hex.DecodeString(p); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(p); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, errors.New("want a sha256 digest in hex or base64")
+}
+
+// bearerTransport adds the API token to requests for the configured hosts
+// only, so a redirect elsewhere never carries the credential.
+type bearerTransport struct {
+	base  http.RoundTripper
+	token string
+	hosts map[string]bool
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.hosts[req.URL.Host] && req.Header.Get("Authorization") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return t.base.RoundTrip(req)
+}
+
+func hosts(urls ...string) map[string]bool {
+	out := map[string]bool{}
+	for _, u := range urls {
+		if pu, err := url.Parse(u); err == nil && pu.Host != "" {
+			out[pu.Host] = true
+		}
+	}
+	return out
+}
@@ -0,0 +1,5 @@
+package version
+
+// Version is the agent release, overridable at build time with
+// -ldflags "-X sentinel-agent/internal/version.Version=...".
+var Version = "1.0.0"
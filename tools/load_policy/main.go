@@ -1,32 +1,33 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
-	"gopkg.in/yaml.v3"
-
 	"sentinel-agent/internal/config"
+	"sentinel-agent/internal/events"
 	"sentinel-agent/internal/policy"
+	"sentinel-agent/internal/storage"
 )
 
-type YPolicy struct {
-	ID    string           `yaml:"id"`
-	Name  string           `yaml:"name"`
-	Rules []map[string]any `yaml:"rules"`
-}
-
-type YDoc struct {
-	Version  int       `yaml:"version"`
-	Policies []YPolicy `yaml:"policies"`
-}
-
 func main() {
 	yamlPath := flag.String("f", "policies.yaml", "path to policies YAML")
+	sigPath := flag.String("sig", "", "detached signature to verify against policy_keys (e.g. policies.yaml.sig); required when policy_keys are configured")
+	history := flag.String("history", "", "print the stored revisions of this policy id")
+	rollback := flag.String("rollback", "", "re-activate an earlier revision of this policy id")
+	revision := flag.Int64("revision", 0, "revision to roll back to (default: the one before the active revision)")
+	state := flag.String("state", "", "state new revisions start in: staged, dry_run or active (default policy_default_state)")
+	promote := flag.String("promote", "", "move this policy id one state up (staged -> dry_run -> active)")
+	demote := flag.String("demote", "", "move this policy id one state down (active -> dry_run -> staged -> retired)")
+	to := flag.String("to", "", "with -promote or -demote, the state to move to instead of the next one")
 	flag.Parse()
 
 	cfg, err := config.Load()
@@ -34,42 +35,197 @@ func main() {
 		fmt.Fprintln(os.Stderr, "failed to load config:", err)
 		os.Exit(1)
 	}
+	if *state != "" && !policy.InitialState(*state) {
+		fmt.Fprintf(os.Stderr, "unknown -state %q (want staged, dry_run or active)\n", *state)
+		os.Exit(1)
+	}
+
+	if *history != "" || *rollback != "" || *promote != "" || *demote != "" {
+		db, err := storage.Open(cfg.DBPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "open policy db:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		if *history != "" {
+			revs, err := db.Policies().History(*history)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "read history:", err)
+				os.Exit(1)
+			}
+			b, _ := json.MarshalIndent(revs, "", "  ")
+			fmt.Println(string(b))
+			return
+		}
+		if *rollback != "" {
+			err = rollbackPolicy(cfg, db, *rollback, *revision)
+		} else if *promote != "" {
+			err = moveState(cfg, db, *promote, *to, true)
+		} else {
+			err = moveState(cfg, db, *demote, *to, false)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
 
 	b, err := ioutil.ReadFile(*yamlPath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "read policy file:", err)
 		os.Exit(1)
 	}
-	var doc YDoc
-	if err := yaml.Unmarshal(b, &doc); err != nil {
-		fmt.Fprintln(os.Stderr, "yaml parse error:", err)
+	// nothing is stored unless the whole file validates
+	doc, err := policy.Parse(b)
+	if err != nil {
+		var verr *policy.ValidationError
+		if errors.As(err, &verr) {
+			for _, p := range verr.Problems {
+				fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", *yamlPath, p.Line, p.Column, p.Path, p.Msg)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *yamlPath, err)
+		}
+		os.Exit(1)
+	}
+
+	// with trusted keys configured only signed documents are stored, as for
+	// fetched ones
+	if *sigPath == "" && len(cfg.PolicyKeys) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: policy_keys are configured; -sig is required\n", *yamlPath)
 		os.Exit(1)
 	}
+	var sig policy.Signature
+	if *sigPath != "" {
+		if sig, err = verify(cfg, b, *sigPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: signature rejected: %v\n", *yamlPath, err)
+			os.Exit(1)
+		}
+	}
 
-	ps, err := policy.NewDBStore(cfg.DBPath)
+	db, err := storage.Open(cfg.DBPath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "open policy db:", err)
 		os.Exit(1)
 	}
-	defer ps.Close()
+	defer db.Close()
+	ps := db.Policies()
 
-	for _, p := range doc.Policies {
-		j, _ := json.Marshal(map[string]any{
-			"version": doc.Version,
-			"id":      p.ID,
-			"name":    p.Name,
-			"rules":   p.Rules,
-		})
-		pol := &policy.Policy{
-			ID:      p.ID,
-			Name:    p.Name,
-			Raw:     string(j),
-			Updated: time.Now().UTC(),
+	src, _ := filepath.Abs(*yamlPath)
+	source := "file:" + src
+	if sig.Serial > 0 {
+		if err := ps.CheckSerial(source, sig.Serial, policy.Hash(string(b))); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: signature rejected: %v\n", *yamlPath, err)
+			db.Close()
+			os.Exit(1)
+		}
+	}
+	failed := false
+	for _, pol := range doc.Stored(source, time.Now()) {
+		pol.Verified, pol.KeyID = sig.KeyID != "", sig.KeyID
+		if *state != "" {
+			pol.State = *state
+		} else if pol.State == "" {
+			pol.State = cfg.PolicyDefaultState
 		}
 		if err := ps.Set(pol); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to set policy %s: %v\n", p.ID, err)
+			fmt.Fprintf(os.Stderr, "failed to set policy %s: %v\n", pol.ID, err)
+			failed = true
 		} else {
-			fmt.Println("stored policy", p.ID)
+			fmt.Println("stored policy", pol.ID, "revision", pol.Revision, "state", pol.State)
 		}
 	}
+	if sig.Serial > 0 && !failed {
+		if err := ps.SetSerial(source, sig.Serial, policy.Hash(string(b)), time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, "record policy serial:", err)
+		}
+	}
+}
+
+// verify checks the detached signature in sigPath over doc against the
+// configured policy_keys and returns it.
+func verify(cfg *config.Config, doc []byte, sigPath string) (policy.Signature, error) {
+	keys := policy.KeyRing{}
+	for _, k := range cfg.PolicyKeys {
+		if err := keys.Add(k.ID, k.PublicKey); err != nil {
+			return policy.Signature{}, err
+		}
+	}
+	if len(keys) == 0 {
+		return policy.Signature{}, errors.New("no policy_keys configured")
+	}
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return policy.Signature{}, err
+	}
+	return keys.Verify(doc, sig)
+}
+
+// rollbackPolicy re-activates an earlier revision and records a policy_rollback event.
+func rollbackPolicy(cfg *config.Config, db *storage.DB, id string, revision int64) error {
+	from, p, err := db.Policies().Rollback(id, revision)
+	if err != nil {
+		return err
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"policy_id":     p.ID,
+		"from_revision": from,
+		"to_revision":   p.Revision,
+		"hash":          p.Hash,
+		"source":        p.Source,
+	})
+	if err := record(cfg, db, "policy_rollback", payload); err != nil {
+		return fmt.Errorf("policy rolled back but event not recorded: %w", err)
+	}
+	fmt.Printf("policy %s rolled back from revision %d to %d\n", p.ID, from, p.Revision)
+	return nil
+}
+
+// moveState promotes or demotes a policy, by one step unless to names the
+// target state, and records a policy_state_changed event.
+func moveState(cfg *config.Config, db *storage.DB, id, to string, up bool) error {
+	if to == "" {
+		p, err := db.Policies().Find(id)
+		if err != nil {
+			return err
+		}
+		if to = policy.Step(p.State, up); to == "" {
+			return fmt.Errorf("policy %s is %s and cannot move further", id, p.State)
+		}
+	}
+	t, err := db.Policies().SetState(id, to, time.Now())
+	if err != nil {
+		return err
+	}
+	payload, _ := json.Marshal(map[string]any{
+		"policy_id": t.PolicyID,
+		"revision":  t.Revision,
+		"from":      t.From,
+		"to":        t.To,
+		"actor":     "load_policy",
+	})
+	if err := record(cfg, db, "policy_state_changed", payload); err != nil {
+		return fmt.Errorf("policy state changed but event not recorded: %w", err)
+	}
+	fmt.Printf("policy %s revision %d: %s -> %s\n", id, t.Revision, t.From, t.To)
+	return nil
+}
+
+// record stores an audit event, which the agent delivers with its own events.
+func record(cfg *config.Config, db *storage.DB, typ string, payload []byte) error {
+	host, _ := os.Hostname()
+	corr := make([]byte, 16)
+	_, _ = rand.Read(corr)
+	return db.Events().Save(events.Event{
+		Timestamp:     time.Now().UTC(),
+		Type:          typ,
+		Severity:      events.SeverityMedium,
+		Module:        "load_policy",
+		AgentID:       cfg.AgentID,
+		Hostname:      host,
+		CorrelationID: hex.EncodeToString(corr),
+		Payload:       string(payload),
+	})
 }
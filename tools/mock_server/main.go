@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/gateway"
+	"sentinel-agent/internal/tasks"
+	"sentinel-agent/internal/transport"
+)
+
+// mock_server is a reference gateway and policy server for local integration
+// testing. It stores uploads in its own SQLite file, serves policy YAML from
+// a directory with ETags and a long-poll watch endpoint, can inject failures
+// and latency, and exposes what it received under /_mock/.
+//
+//	POST /api/events              event uploads (point gateway_url here)
+//	GET  /policies/{file}         policy documents (point policy_url here)
+//	GET  /watch/policies/{file}   long-poll for changes (point policy_push_url here)
+//	GET  /_mock/events            stored events, newest first (?type=&agent_id=&limit=)
+//	GET  /_mock/stats             uploads and events per agent
+//	GET  /_mock/tasks             queued tasks and their results
+//	POST /_mock/tasks             queue a task: {"agent_id","type","args","expires_in"}
+//	GET  /_mock/faults            current fault injection settings
+//	PUT  /_mock/faults            replace them
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
+	dbPath := flag.String("db", "mock_server.db", "SQLite file for received uploads")
+	polDir := flag.String("policies", "policies", "directory of policy YAML files")
+	keyFile := flag.String("hmac-key-file", "", "shared HMAC key: verify uploads, sign responses and tasks")
+	token := flag.String("token", "", "require this bearer token on uploads and policy requests")
+	certFile := flag.String("tls-cert", "", "serve HTTPS with this certificate")
+	keyPEM := flag.String("tls-key", "", "key for -tls-cert")
+	var f faults
+	flag.Float64Var(&f.FailRate, "fail-rate", 0, "fraction of requests answered with -fail-status")
+	flag.IntVar(&f.Status, "fail-status", http.StatusServiceUnavailable, "status for injected failures")
+	flag.IntVar(&f.RetryAfter, "retry-after", 0, "Retry-After seconds sent with injected failures")
+	flag.IntVar(&f.LatencyMS, "latency-ms", 0, "delay before answering each request")
+	flag.Float64Var(&f.RejectRate, "reject-rate", 0, "fraction of uploaded events rejected in acks")
+	flag.Parse()
+	log.SetPrefix("mock_server ")
+
+	st, err := openStore(*dbPath)
+	if err != nil {
+		log.Fatalf("open %s: %v", *dbPath, err)
+	}
+	srv := &server{store: st, policies: newPolicyDir(*polDir), token: *token, faults: f}
+	if *keyFile != "" {
+		key, err := transport.ReadSecret(*keyFile)
+		if err != nil {
+			log.Fatalf("hmac key: %v", err)
+		}
+		srv.key = []byte(key)
+	}
+	go srv.policies.watch(500*time.Millisecond, nil)
+
+	log.Printf("mock server listening on %s (db %s, policies %s)", *addr, *dbPath, *polDir)
+	if *certFile != "" {
+		err = http.ListenAndServeTLS(*addr, *certFile, *keyPEM, srv.routes())
+	} else {
+		err = http.ListenAndServe(*addr, srv.routes())
+	}
+	log.Fatal(err)
+}
+
+// routes serves the agent-facing endpoints and the /_mock/ inspection API.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/events", s.inject(s.upload))
+	mux.Handle("GET /policies/{file}", s.inject(s.policy))
+	mux.Handle("GET /watch/policies/{file}", s.inject(s.watch))
+	mux.HandleFunc("GET /_mock/events", s.listEvents)
+	mux.HandleFunc("GET /_mock/stats", s.stats)
+	mux.HandleFunc("GET /_mock/tasks", s.listTasks)
+	mux.HandleFunc("POST /_mock/tasks", s.addTask)
+	mux.HandleFunc("GET /_mock/faults", s.getFaults)
+	mux.HandleFunc("PUT /_mock/faults", s.setFaults)
+	return mux
+}
+
+// faults configures injected misbehaviour for the agent-facing endpoints.
+type faults struct {
+	FailRate   float64 `json:"fail_rate"`
+	Status     int     `json:"status"`
+	RetryAfter int     `json:"retry_after"`
+	LatencyMS  int     `json:"latency_ms"`
+	RejectRate float64 `json:"reject_rate"`
+}
+
+type server struct {
+	store    *store
+	policies *policyDir
+	key      []byte
+	token    string
+	mu       sync.Mutex
+	faults   faults
+}
+
+func (s *server) currentFaults() faults {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.faults
+}
+
+// inject applies latency, injected failures and the bearer token check before h.
+func (s *server) inject(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := s.currentFaults()
+		if f.LatencyMS > 0 {
+			select {
+			case <-time.After(time.Duration(f.LatencyMS) * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.FailRate > 0 && mrand.Float64() < f.FailRate {
+			if f.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(f.RetryAfter))
+			}
+			status := f.Status
+			if status == 0 {
+				status = http.StatusServiceUnavailable
+			}
+			http.Error(w, "injected failure", status)
+			return
+		}
+		if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+func (s *server) upload(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	agentID := r.Header.Get(gateway.HeaderAgent)
+	if s.key != nil {
+		// the signature covers the body as sent, before decompression
+		if err := gateway.Verify(s.key, r.Header.Get(gateway.HeaderTimestamp), agentID, body, r.Header.Get(gateway.HeaderSignature), time.Now()); err != nil {
+			http.Error(w, "signature: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var env gateway.Envelope
+	if err := json.Unmarshal(body, &env); err != nil || env.Version != gateway.ProtocolVersion {
+		http.Error(w, "expected a version 1 upload envelope", http.StatusBadRequest)
+		return
+	}
+	if s.key != nil && env.AgentID != agentID {
+		http.Error(w, "envelope agent does not match the signed agent", http.StatusUnauthorized)
+		return
+	}
+	// a retried batch gets the ack it was sent the first time
+	if ack, ok, err := s.store.seenAck(env.AgentID, env.Sequence); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if ok {
+		s.reply(w, r, env.AgentID, ack)
+		return
+	}
+	var evts []events.Event
+	if err := json.Unmarshal(env.Events, &evts); err != nil {
+		http.Error(w, "events: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ack := gateway.Ack{Version: gateway.ProtocolVersion, Sequence: env.Sequence, Accepted: []int64{}, Rejected: []gateway.Rejection{}}
+	accepted := map[int64]bool{}
+	rejectRate := s.currentFaults().RejectRate
+	for _, e := range evts {
+		if rejectRate > 0 && mrand.Float64() < rejectRate {
+			ack.Rejected = append(ack.Rejected, gateway.Rejection{ID: e.ID, Reason: "injected rejection"})
+			continue
+		}
+		accepted[e.ID] = true
+		ack.Accepted = append(ack.Accepted, e.ID)
+	}
+	stored, _ := json.Marshal(ack)
+	if err := s.store.saveUpload(env.AgentID, env.Hostname, env.AgentVersion, env.Sequence, evts, accepted, len(body), stored); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("upload agent=%s seq=%d events=%d rejected=%d", env.AgentID, env.Sequence, len(evts), len(ack.Rejected))
+	s.reply(w, r, env.AgentID, stored)
+}
+
+// reply sends an ack, adding the agent's queued tasks and, with a key, signing
+// it as the answer to request r.
+func (s *server) reply(w http.ResponseWriter, r *http.Request, agentID string, stored []byte) {
+	var ack gateway.Ack
+	_ = json.Unmarshal(stored, &ack)
+	ts, err := s.store.pendingTasks(agentID, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, t := range ts {
+		if s.key != nil {
+			t.Signature = gateway.SignTask(s.key, agentID, t)
+		}
+		ack.Tasks = append(ack.Tasks, t)
+	}
+	body, _ := json.Marshal(ack)
+	if s.key != nil {
+		now := strconv.FormatInt(time.Now().Unix(), 10)
+		w.Header().Set(gateway.HeaderTimestamp, now)
+		w.Header().Set(gateway.HeaderSignature, gateway.SignResponse(s.key, now, agentID, r.Header.Get(gateway.HeaderSignature), body))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func (s *server) policy(w http.ResponseWriter, r *http.Request) {
+	b, etag, err := s.policies.read(r.PathValue("file"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(b)
+}
+
+// watch answers with the file's version as soon as it differs from the
+// client's If-None-Match, or 304 once ?wait= seconds (default 30) pass.
+func (s *server) watch(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	wait := 30 * time.Second
+	if n, err := strconv.Atoi(r.URL.Query().Get("wait")); err == nil && n > 0 {
+		wait = time.Duration(n) * time.Second
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	for {
+		etag, changed := s.policies.etag(name)
+		if etag == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if etag != r.Header.Get("If-None-Match") {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"version": etag})
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *server) listEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = 100
+	}
+	evts, err := s.store.listEvents(q.Get("type"), q.Get("agent_id"), limit)
+	writeJSON(w, evts, err)
+}
+
+func (s *server) stats(w http.ResponseWriter, r *http.Request) {
+	st, err := s.store.stats()
+	writeJSON(w, st, err)
+}
+
+func (s *server) listTasks(w http.ResponseWriter, r *http.Request) {
+	ts, err := s.store.listTasks()
+	writeJSON(w, ts, err)
+}
+
+func (s *server) addTask(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AgentID   string          `json:"agent_id"`
+		Type      string          `json:"type"`
+		Args      json.RawMessage `json:"args"`
+		ExpiresIn int64           `json:"expires_in"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AgentID == "" || req.Type == "" {
+		http.Error(w, "expected {\"agent_id\",\"type\",\"args\",\"expires_in\"}", http.StatusBadRequest)
+		return
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	now := time.Now().Unix()
+	// agents refuse tasks without an expiry
+	if req.ExpiresIn <= 0 {
+		req.ExpiresIn = 3600
+	}
+	t := tasks.Task{ID: hex.EncodeToString(id), Type: req.Type, Args: req.Args, Issued: now, Expires: now + req.ExpiresIn}
+	if err := s.store.addTask(req.AgentID, t); err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	writeJSON(w, t, nil)
+}
+
+func (s *server) getFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.currentFaults(), nil)
+}
+
+func (s *server) setFaults(w http.ResponseWriter, r *http.Request) {
+	var f faults
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.faults = f
+	s.mu.Unlock()
+	log.Printf("faults set: %+v", f)
+	writeJSON(w, f, nil)
+}
+
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, "encode:", err)
+	}
+}
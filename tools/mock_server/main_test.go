@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sentinel-agent/internal/config"
+	"sentinel-agent/internal/logging"
+	"sentinel-agent/internal/service"
+	"sentinel-agent/internal/sinks"
+	"sentinel-agent/internal/storage"
+	"sentinel-agent/internal/tasks"
+)
+
+const testPolicy = `version: 1
+policies:
+  - id: e2e
+    rules:
+      - {id: r1, type: block_process, match: no-such-process.exe, action: alert}
+`
+
+// TestServiceAgainstMock runs the agent against the mock server and checks
+// that events are uploaded and acknowledged and the policy is fetched.
+func TestServiceAgainstMock(t *testing.T) {
+	dir := t.TempDir()
+	st, err := openStore(filepath.Join(dir, "mock.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.db.Close()
+	polDir := filepath.Join(dir, "policies")
+	if err := os.Mkdir(polDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(polDir, "agent.yaml"), []byte(testPolicy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{store: st, policies: newPolicyDir(polDir)}
+	ts := httptest.NewServer(srv.routes())
+	defer ts.Close()
+
+	cfg := &config.Config{
+		GatewayURL:                       ts.URL + "/api/events",
+		AgentID:                          "e2e-agent",
+		PollIntervalSeconds:              3600,
+		LogLevel:                         "error",
+		DBPath:                           filepath.Join(dir, "agent", "events.db"),
+		PolicyURL:                        ts.URL + "/policies/agent.yaml",
+		PolicyPollSeconds:                3600,
+		PolicyDefaultState:               "active",
+		HTTPTimeoutSeconds:               5,
+		DialTimeoutSeconds:               5,
+		TLSHandshakeTimeoutSeconds:       5,
+		GatewayMaxBatchEvents:            500,
+		GatewayMaxBatchKB:                1024,
+		GatewayBreakerThreshold:          3,
+		GatewayBreakerCooldownSeconds:    30,
+		GatewayBreakerMaxCooldownSeconds: 600,
+		DeliveryBatchSize:                100,
+		DeliveryMaxBackoffSeconds:        600,
+		RetentionIntervalSeconds:         3600,
+		ViolationRealertSeconds:          3600,
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.DBPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	svc := service.New(cfg, logging.New(cfg))
+	done := make(chan struct{})
+	go func() {
+		svc.Run()
+		close(done)
+	}()
+	defer func() {
+		svc.Stop()
+		<-done
+	}()
+
+	// a second handle on the agent's database to watch its side
+	db, err := storage.Open(cfg.DBPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var uploaded, acked, fetched bool
+	for deadline := time.Now().Add(15 * time.Second); !(uploaded && acked && fetched); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("uploaded=%v acked=%v policy fetched=%v", uploaded, acked, fetched)
+		}
+		evts, err := st.listEvents("sysinfo", cfg.AgentID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploaded = len(evts) > 0
+		pending, err := db.Events().Pending(sinks.DefaultName, 100, time.Now().Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		acked = uploaded
+		for _, e := range pending {
+			if e.Type == "sysinfo" {
+				acked = false
+			}
+		}
+		if p, err := db.Policies().Find("e2e"); err == nil {
+			if p.Source != "url:"+cfg.PolicyURL {
+				t.Fatalf("policy source %q, want the policy_url", p.Source)
+			}
+			fetched = true
+		}
+	}
+}
+
+func TestPendingTasksSkipsExpired(t *testing.T) {
+	st, err := openStore(filepath.Join(t.TempDir(), "mock.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.db.Close()
+	now := time.Now()
+	for _, tk := range []tasks.Task{
+		{ID: "live", Type: "ping", Issued: now.Unix(), Expires: now.Add(time.Hour).Unix()},
+		{ID: "expired", Type: "ping", Issued: now.Add(-2 * time.Hour).Unix(), Expires: now.Add(-time.Hour).Unix()},
+		{ID: "open", Type: "ping", Issued: now.Unix()},
+	} {
+		if err := st.addTask("a1", tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := st.pendingTasks("a1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for _, tk := range got {
+		ids[tk.ID] = true
+	}
+	if len(ids) != 2 || !ids["live"] || !ids["open"] {
+		t.Errorf("pending tasks %v, want live and open", ids)
+	}
+}
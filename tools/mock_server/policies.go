@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// policyDir serves the YAML files in a directory, with their detached .sig
+// signatures, and notices when either changes.
+type policyDir struct {
+	dir     string
+	mu      sync.Mutex
+	etags   map[string]string
+	changed chan struct{} // closed and replaced on every change
+}
+
+func newPolicyDir(dir string) *policyDir {
+	p := &policyDir{dir: dir, etags: map[string]string{}, changed: make(chan struct{})}
+	p.scan()
+	return p
+}
+
+// watch rescans the directory every interval until stop is closed.
+func (p *policyDir) watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.scan()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *policyDir) scan() {
+	etags := map[string]string{}
+	entries, _ := os.ReadDir(p.dir)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".sig")) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(p.dir, name))
+		if err != nil {
+			continue
+		}
+		etags[name] = p.version(name, b)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	same := len(etags) == len(p.etags)
+	for k, v := range etags {
+		if p.etags[k] != v {
+			same = false
+		}
+	}
+	if same {
+		return
+	}
+	p.etags = etags
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// etag returns the current ETag of name ("" when it does not exist) and a
+// channel closed on the next change to the directory.
+func (p *policyDir) etag(name string) (string, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.etags[name], p.changed
+}
+
+// read returns the content of name together with its ETag.
+func (p *policyDir) read(name string) ([]byte, string, error) {
+	if name != filepath.Base(name) {
+		return nil, "", os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(p.dir, name))
+	if err != nil {
+		return nil, "", err
+	}
+	return b, p.version(name, b), nil
+}
+
+// version is the ETag of name with content b. It covers the file's .sig as
+// well, so re-signing a policy is announced and refetched like an edit.
+func (p *policyDir) version(name string, b []byte) string {
+	h := sha256.New()
+	h.Write(b)
+	if sig, err := os.ReadFile(filepath.Join(p.dir, name+".sig")); err == nil {
+		h.Write([]byte{0})
+		h.Write(sig)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/tasks"
+)
+
+// store keeps what the mock server received in its own SQLite file.
+type store struct {
+	db *sql.DB
+}
+
+func openStore(path string) (*store, error) {
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "busy_timeout(5000)")
+	q.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS uploads (
+            agent_id TEXT NOT NULL,
+            sequence INTEGER NOT NULL,
+            hostname TEXT NOT NULL,
+            agent_version TEXT NOT NULL,
+            events INTEGER NOT NULL,
+            bytes INTEGER NOT NULL,
+            ack TEXT NOT NULL,
+            received TEXT NOT NULL,
+            PRIMARY KEY (agent_id, sequence)
+        );
+        CREATE TABLE IF NOT EXISTS events (
+            agent_id TEXT NOT NULL,
+            event_id INTEGER NOT NULL,
+            sequence INTEGER NOT NULL,
+            timestamp TEXT NOT NULL,
+            type TEXT NOT NULL,
+            severity TEXT NOT NULL,
+            module TEXT NOT NULL,
+            payload TEXT NOT NULL,
+            received TEXT NOT NULL,
+            PRIMARY KEY (agent_id, event_id)
+        );
+        CREATE TABLE IF NOT EXISTS tasks (
+            id TEXT PRIMARY KEY,
+            agent_id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            args TEXT NOT NULL DEFAULT '',
+            issued INTEGER NOT NULL,
+            expires INTEGER NOT NULL DEFAULT 0,
+            delivered INTEGER NOT NULL DEFAULT 0
+        );`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+// seenAck returns the ack sent for an earlier upload with the same sequence, if any.
+func (s *store) seenAck(agentID string, seq int64) (json.RawMessage, bool, error) {
+	var ack string
+	err := s.db.QueryRow(`SELECT ack FROM uploads WHERE agent_id = ? AND sequence = ?`, agentID, seq).Scan(&ack)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return json.RawMessage(ack), err == nil, err
+}
+
+// saveUpload records an upload, its accepted events and the ack sent for it.
+// Events already stored under the same agent and event id are kept once.
+func (s *store) saveUpload(agentID, hostname, version string, seq int64, evts []events.Event, accepted map[int64]bool, bytes int, ack []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(time.RFC3339)
+	if _, err := tx.Exec(`INSERT INTO uploads(agent_id, sequence, hostname, agent_version, events, bytes, ack, received)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, agentID, seq, hostname, version, len(evts), bytes, string(ack), now); err != nil {
+		return err
+	}
+	for _, e := range evts {
+		if !accepted[e.ID] {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO events(agent_id, event_id, sequence, timestamp, type, severity, module, payload, received)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, agentID, e.ID, seq, e.Timestamp.UTC().Format(time.RFC3339),
+			e.Type, e.Severity, e.Module, e.Payload, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *store) addTask(agentID string, t tasks.Task) error {
+	_, err := s.db.Exec(`INSERT INTO tasks(id, agent_id, type, args, issued, expires) VALUES (?, ?, ?, ?, ?, ?)`,
+		t.ID, agentID, t.Type, string(t.Args), t.Issued, t.Expires)
+	return err
+}
+
+// pendingTasks returns the unexpired tasks queued for agentID that it has not
+// reported a task_result for yet, counting each delivery. Agents run a task ID
+// only once, so resending until the result arrives is safe.
+func (s *store) pendingTasks(agentID string, now time.Time) ([]tasks.Task, error) {
+	rows, err := s.db.Query(`UPDATE tasks SET delivered = delivered + 1 WHERE agent_id = ?
+            AND (expires = 0 OR expires > ?)
+            AND NOT EXISTS (SELECT 1 FROM events WHERE events.agent_id = tasks.agent_id
+                AND events.type = 'task_result' AND json_extract(events.payload, '$.task_id') = tasks.id)
+        RETURNING id, type, args, issued, expires`, agentID, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []tasks.Task
+	for rows.Next() {
+		var t tasks.Task
+		var args string
+		if err := rows.Scan(&t.ID, &t.Type, &args, &t.Issued, &t.Expires); err != nil {
+			return nil, err
+		}
+		if args != "" {
+			t.Args = json.RawMessage(args)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+type storedEvent struct {
+	AgentID  string          `json:"agent_id"`
+	EventID  int64           `json:"event_id"`
+	Sequence int64           `json:"sequence"`
+	Time     string          `json:"timestamp"`
+	Type     string          `json:"type"`
+	Severity string          `json:"severity"`
+	Module   string          `json:"module"`
+	Payload  json.RawMessage `json:"payload"`
+	Received string          `json:"received"`
+}
+
+// listEvents returns the newest stored events, optionally of one type or agent.
+func (s *store) listEvents(typ, agentID string, limit int) ([]storedEvent, error) {
+	rows, err := s.db.Query(`SELECT agent_id, event_id, sequence, timestamp, type, severity, module, payload, received
+        FROM events WHERE (? = '' OR type = ?) AND (? = '' OR agent_id = ?)
+        ORDER BY received DESC, event_id DESC LIMIT ?`, typ, typ, agentID, agentID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []storedEvent{}
+	for rows.Next() {
+		var e storedEvent
+		var payload string
+		if err := rows.Scan(&e.AgentID, &e.EventID, &e.Sequence, &e.Time, &e.Type, &e.Severity, &e.Module, &payload, &e.Received); err != nil {
+			return nil, err
+		}
+		if json.Valid([]byte(payload)) {
+			e.Payload = json.RawMessage(payload)
+		} else {
+			e.Payload, _ = json.Marshal(payload)
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+type agentStats struct {
+	AgentID      string `json:"agent_id"`
+	Hostname     string `json:"hostname"`
+	AgentVersion string `json:"agent_version"`
+	Uploads      int64  `json:"uploads"`
+	Events       int64  `json:"events"`
+	LastSequence int64  `json:"last_sequence"`
+	LastUpload   string `json:"last_upload"`
+}
+
+type taskStatus struct {
+	tasks.Task
+	AgentID   string          `json:"agent_id"`
+	Delivered int             `json:"delivered"`
+	Result    json.RawMessage `json:"result,omitempty"`
+}
+
+// listTasks returns every queued task with the agent's task_result, if any.
+func (s *store) listTasks() ([]taskStatus, error) {
+	rows, err := s.db.Query(`SELECT id, agent_id, type, args, issued, expires, delivered,
+            (SELECT payload FROM events WHERE events.agent_id = tasks.agent_id AND events.type = 'task_result'
+                AND json_extract(events.payload, '$.task_id') = tasks.id)
+        FROM tasks ORDER BY issued, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []taskStatus{}
+	for rows.Next() {
+		var t taskStatus
+		var args string
+		var result sql.NullString
+		if err := rows.Scan(&t.ID, &t.AgentID, &t.Type, &args, &t.Issued, &t.Expires, &t.Delivered, &result); err != nil {
+			return nil, err
+		}
+		if args != "" {
+			t.Args = json.RawMessage(args)
+		}
+		if result.Valid {
+			t.Result = json.RawMessage(result.String)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *store) stats() ([]agentStats, error) {
+	rows, err := s.db.Query(`SELECT u.agent_id, MAX(u.hostname), MAX(u.agent_version), COUNT(*), MAX(u.sequence), MAX(u.received),
+            (SELECT COUNT(*) FROM events e WHERE e.agent_id = u.agent_id)
+        FROM uploads u GROUP BY u.agent_id ORDER BY u.agent_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []agentStats{}
+	for rows.Next() {
+		var a agentStats
+		if err := rows.Scan(&a.AgentID, &a.Hostname, &a.AgentVersion, &a.Uploads, &a.LastSequence, &a.LastUpload, &a.Events); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
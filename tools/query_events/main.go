@@ -1,61 +1,144 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
-	_ "modernc.org/sqlite"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
+
+	"sentinel-agent/internal/config"
+	"sentinel-agent/internal/events"
+	"sentinel-agent/internal/storage"
 )
 
 func main() {
-	progData := os.Getenv("ProgramData")
-	if progData == "" {
-		progData = `C:\\ProgramData`
+	types := flag.String("type", "", "comma-separated event types to include")
+	module := flag.String("module", "", "only events produced by this module")
+	since := flag.String("since", "", "only events at or after this time (RFC3339, or a duration such as 24h meaning that long ago)")
+	until := flag.String("until", "", "only events before this time (RFC3339 or duration ago)")
+	cursor := flag.Int64("cursor", 0, "page cursor (event id) from a previous result")
+	forward := flag.Bool("forward", false, "page oldest-first (ids above the cursor) instead of newest-first")
+	limit := flag.Int("limit", 20, "maximum events to return")
+	count := flag.Bool("count", false, "print the number of matching events instead of the events")
+	search := flag.String("search", "", "full-text search over event types and payloads; prints ranked matches with highlighted snippets")
+	fields := map[string]string{}
+	flag.Func("field", "payload field equality filter key=value (repeatable, dotted keys allowed)", func(v string) error {
+		k, val, ok := strings.Cut(v, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("expected key=value, got %q", v)
+		}
+		fields[k] = val
+		return nil
+	})
+	flag.Parse()
+
+	q := events.Query{Module: *module, Fields: fields, Cursor: *cursor, Limit: *limit}
+	if *types != "" {
+		q.Types = strings.Split(*types, ",")
+	}
+	if *forward {
+		q.Direction = events.Forward
+	}
+	var err error
+	if q.Since, err = parseTime(*since); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -since:", err)
+		os.Exit(2)
+	}
+	if q.Until, err = parseTime(*until); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -until:", err)
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		os.Exit(1)
 	}
-	dbPath := filepath.Join(progData, "SentinelAgent", "events.db")
-	if _, err := os.Stat(dbPath); err != nil {
-		fmt.Fprintf(os.Stderr, "events.db not found at %s: %v\n", dbPath, err)
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		fmt.Fprintf(os.Stderr, "events.db not found at %s: %v\n", cfg.DBPath, err)
 		os.Exit(1)
 	}
-	db, err := sql.Open("sqlite", dbPath)
+	db, err := storage.Open(cfg.DBPath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "open db error:", err)
 		os.Exit(1)
 	}
 	defer db.Close()
+	store := db.Events()
 
-	rows, err := db.Query("SELECT id, timestamp, type, payload FROM events ORDER BY id DESC LIMIT 20")
+	if *count {
+		n, err := store.Count(q)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "query error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(n)
+		return
+	}
+
+	if *search != "" {
+		results, err := store.Search(*search, q)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "search error:", err)
+			os.Exit(1)
+		}
+		out := make([]map[string]any, 0, len(results))
+		for _, r := range results {
+			m := render(r.Event)
+			m["rank"] = r.Rank
+			m["snippet"] = r.Snippet
+			out = append(out, m)
+		}
+		b, _ := json.MarshalIndent(out, "", "  ")
+		fmt.Println(string(b))
+		return
+	}
+
+	page, err := store.Query(q)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "query error:", err)
 		os.Exit(1)
 	}
-	defer rows.Close()
-
-	out := make([]map[string]any, 0)
-	for rows.Next() {
-		var id int64
-		var ts string
-		var typ string
-		var payload string
-		if err := rows.Scan(&id, &ts, &typ, &payload); err != nil {
-			fmt.Fprintln(os.Stderr, "scan error:", err)
-			continue
-		}
-		m := map[string]any{"id": id, "timestamp": ts, "type": typ}
-		var p any
-		if json.Unmarshal([]byte(payload), &p) == nil {
-			m["payload"] = p
-		} else {
-			if len(payload) > 200 {
-				m["payload"] = payload[:200] + "..."
-			} else {
-				m["payload"] = payload
-			}
-		}
-		out = append(out, m)
+	out := make([]map[string]any, 0, len(page.Events))
+	for _, e := range page.Events {
+		out = append(out, render(e))
 	}
-	b, _ := json.MarshalIndent(out, "", "  ")
+	b, _ := json.MarshalIndent(map[string]any{"events": out, "next": page.Next, "prev": page.Prev}, "", "  ")
 	fmt.Println(string(b))
 }
+
+// render decodes JSON payloads for readability and truncates anything else.
+func render(e events.Event) map[string]any {
+	m := map[string]any{
+		"id":             e.ID,
+		"timestamp":      e.Timestamp.Format(time.RFC3339),
+		"type":           e.Type,
+		"severity":       e.Severity,
+		"module":         e.Module,
+		"agent_id":       e.AgentID,
+		"hostname":       e.Hostname,
+		"schema_version": e.SchemaVersion,
+		"correlation_id": e.CorrelationID,
+	}
+	var p any
+	if json.Unmarshal([]byte(e.Payload), &p) == nil {
+		m["payload"] = p
+	} else if len(e.Payload) > 200 {
+		m["payload"] = e.Payload[:200] + "..."
+	} else {
+		m["payload"] = e.Payload
+	}
+	return m
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"sentinel-agent/internal/policy"
+)
+
+// sign_policy creates Ed25519 policy signing keys and detached policy
+// signatures for agents configured with policy_keys.
+func main() {
+	keygen := flag.Bool("keygen", false, "generate a new signing key into -key and print its public key")
+	keyPath := flag.String("key", "policy_signing.key", "private key file (base64 Ed25519 seed)")
+	keyID := flag.String("id", "", "key ID recorded in the signature; must match the agent's policy_keys entry")
+	docPath := flag.String("f", "policies.yaml", "policy document to sign")
+	out := flag.String("o", "", "signature output (default <f>.sig)")
+	serial := flag.Int64("serial", 0, "signature serial, higher than any earlier document's (default the current unix time)")
+	flag.Parse()
+
+	if *keygen {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "generate key:", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(*keyPath, []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0o600); err != nil {
+			fmt.Fprintln(os.Stderr, "write key:", err)
+			os.Exit(1)
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(pub))
+		return
+	}
+
+	if *keyID == "" {
+		fmt.Fprintln(os.Stderr, "-id is required")
+		os.Exit(1)
+	}
+	b, err := os.ReadFile(*keyPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read key:", err)
+		os.Exit(1)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		fmt.Fprintln(os.Stderr, "key file does not hold a base64 Ed25519 seed")
+		os.Exit(1)
+	}
+	doc, err := os.ReadFile(*docPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "read policy:", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		*out = *docPath + ".sig"
+	}
+	if *serial <= 0 {
+		*serial = time.Now().Unix()
+	}
+	sig := policy.Sign(ed25519.NewKeyFromSeed(seed), *keyID, *serial, doc)
+	if err := os.WriteFile(*out, append(sig, '\n'), 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, "write signature:", err)
+		os.Exit(1)
+	}
+	fmt.Println("wrote", *out, "serial", *serial)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"sentinel-agent/internal/config"
+	"sentinel-agent/internal/storage"
+)
+
+// verify_events walks the event hash chain and reports the first broken link.
+// It exits non-zero when the chain does not verify.
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		os.Exit(1)
+	}
+	if _, err := os.Stat(cfg.DBPath); err != nil {
+		fmt.Fprintf(os.Stderr, "events.db not found at %s: %v\n", cfg.DBPath, err)
+		os.Exit(1)
+	}
+	db, err := storage.Open(cfg.DBPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "open db error:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	rep, err := db.Events().VerifyChain()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify error:", err)
+		os.Exit(1)
+	}
+	b, _ := json.MarshalIndent(rep, "", "  ")
+	fmt.Println(string(b))
+	if !rep.OK {
+		db.Close()
+		os.Exit(2)
+	}
+}